@@ -0,0 +1,256 @@
+package main
+
+/*
+ * Loads the Config for this application. Every param can be set from,
+ * in increasing order of precedence -
+ *      1. defaults in defaultConfig()
+ *      2. a JSON config file given by -config flag or UBER_CONFIG env var,
+ *         for ex. {"listen_addr": ":9090", "max_workers": 8}
+ *      3. environment variables, UBER_ followed by upper cased JSON key,
+ *         for ex. UBER_MAX_WORKERS=8
+ *      4. command line flags, JSON key with '-' for '_', for ex. -max-workers 8
+ * The result is validated before being handed to rest of the application.
+ */
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io/ioutil"
+    "strconv"
+    "strings"
+)
+
+func defaultConfig() *Config {
+    return &Config{
+        ListenAddr:             ":8080",
+        LogLevel:               "info",
+        LogFormat:              "text",
+        SlowRequestMs:          100,
+        DriverIdMode:           DRIVER_IDS_REGISTRY,
+        MinDriverId:            1,
+        MaxDriverId:            50000,
+        Radius:                 500,
+        Limit:                  10,
+        MaxWorkers:             4,
+        MaxQueue:               5000,
+        RetryAfterSec:          1,
+        MaxBatchItems:          1000,
+        MaxBatchBytes:          1 << 20,
+        MaxClockSkewMs:         5000,
+        ReadyQueueFillPct:      90,
+        Store:                  STORE_IN_MEMORY,
+        SqlDriver:              "mysql",
+        SqlDSN:                 "uber:uber@tcp(127.0.0.1:3306)/uber",
+        SnapshotPath:           "drivers.snapshot",
+        SnapshotIntervalSec:    300,
+        WalDir:                 "wal",
+        WalSyncIntervalMs:      200,
+        DriverTTLSec:           180,
+        SweepIntervalSec:       60,
+        HistoryPoints:          120,
+        HistoryMaxAgeSec:       7200,
+        HistoryMaxTotalPoints:  2000000,
+        ReadyDrainSec:          5,
+        ShutdownTimeoutSec:     30,
+    }
+}
+
+/* Describes one param of Config for env var and flag handling.
+ * ptr is one of *string, *int or *float64 pointing into a Config
+ */
+type configField struct {
+    key     string      // JSON key
+    usage   string
+    ptr     interface{}
+}
+
+/* Lists the params of c; order must stay same for every Config
+ */
+func (c *Config) fields() []configField {
+    return []configField{
+        {"listen_addr", "address for HTTP server to listen on", &c.ListenAddr},
+        {"log_level", "least level of logs written - debug, info, warn or error", &c.LogLevel},
+        {"log_format", "format of logs - text or json", &c.LogFormat},
+        {"slow_request_ms", "milliseconds beyond which a request is logged as warning", &c.SlowRequestMs},
+        {"driver_id_mode", "drivers accepted - registry for registered ones, range for legacy id range", &c.DriverIdMode},
+        {"min_driver_id", "smallest valid driver id in range mode", &c.MinDriverId},
+        {"max_driver_id", "largest valid driver id in range mode, also max search limit", &c.MaxDriverId},
+        {"radius", "default search radius in meters", &c.Radius},
+        {"limit", "default count of drivers returned by search", &c.Limit},
+        {"max_workers", "number of workers applying updates", &c.MaxWorkers},
+        {"max_queue", "max updates pending with workers, beyond which PUTs get 503", &c.MaxQueue},
+        {"retry_after_sec", "Retry-After seconds sent with 503 for overload", &c.RetryAfterSec},
+        {"max_batch_items", "most items taken in one batch of locations", &c.MaxBatchItems},
+        {"max_batch_bytes", "most bytes of body taken in one batch of locations", &c.MaxBatchBytes},
+        {"max_clock_skew_ms", "milliseconds a device timestamp can be ahead of server time", &c.MaxClockSkewMs},
+        {"ready_queue_fill_pct", "percent of max_queue pending beyond which /readyz fails", &c.ReadyQueueFillPct},
+        {"store", "DB to keep drivers in - memory or mysql", &c.Store},
+        {"sql_driver", "database/sql driver for mysql store", &c.SqlDriver},
+        {"sql_dsn", "data source name for mysql store", &c.SqlDSN},
+        {"snapshot_path", "snapshot file of memory store", &c.SnapshotPath},
+        {"snapshot_interval_sec", "seconds between snapshots", &c.SnapshotIntervalSec},
+        {"wal_dir", "directory for write-ahead log, empty to disable", &c.WalDir},
+        {"wal_sync_interval_ms", "milliseconds between fsyncs of write-ahead log", &c.WalSyncIntervalMs},
+        {"driver_ttl_sec", "seconds after which a driver not updating is dropped", &c.DriverTTLSec},
+        {"sweep_interval_sec", "seconds between evictions of stale drivers", &c.SweepIntervalSec},
+        {"history_points", "locations kept in history of each driver, 0 to disable", &c.HistoryPoints},
+        {"history_max_age_sec", "seconds for which locations are kept in history", &c.HistoryMaxAgeSec},
+        {"history_max_total_points", "most locations kept in history for all drivers", &c.HistoryMaxTotalPoints},
+        {"ready_drain_sec", "seconds /readyz fails on shutdown before connections are closed", &c.ReadyDrainSec},
+        {"shutdown_timeout_sec", "seconds given to graceful shutdown", &c.ShutdownTimeoutSec},
+    }
+}
+
+/* Sets the param pointed by ptr from its string form
+ */
+func setConfigValue(ptr interface{}, s string) error {
+    switch p := ptr.(type) {
+        case *string:
+            *p = s
+        case *int:
+            v, err := strconv.Atoi(s)
+            if err != nil {
+                return err
+            }
+            *p = v
+        case *float64:
+            v, err := strconv.ParseFloat(s, 64)
+            if err != nil {
+                return err
+            }
+            *p = v
+    }
+    return nil
+}
+
+/* Copies the param pointed by src into dst, both pointing to same kind of field
+ */
+func copyConfigValue(dst, src interface{}) {
+    switch d := dst.(type) {
+        case *string:
+            *d = *src.(*string)
+        case *int:
+            *d = *src.(*int)
+        case *float64:
+            *d = *src.(*float64)
+    }
+}
+
+/* Builds the Config as described on top of this file
+ * Inputs :
+ *      args - command line arguments without program name
+ *      getenv - looks up an environment variable, os.Getenv outside tests
+ * Returns :
+ *      *Config - validated config
+ *      error - in case of bad file, value or failed validation
+ */
+func loadConfig(args []string, getenv func(string) string) (*Config, error) {
+
+    /* flags are parsed into a scratch config as they must be applied last */
+    flagged := defaultConfig()
+    fs := flag.NewFlagSet("uber", flag.ContinueOnError)
+    configPath := fs.String("config", getenv("UBER_CONFIG"), "JSON config file")
+    for _, f := range flagged.fields() {
+        name := strings.Replace(f.key, "_", "-", -1)
+        switch p := f.ptr.(type) {
+            case *string:
+                fs.StringVar(p, name, *p, f.usage)
+            case *int:
+                fs.IntVar(p, name, *p, f.usage)
+            case *float64:
+                fs.Float64Var(p, name, *p, f.usage)
+        }
+    }
+    if err := fs.Parse(args); err != nil {
+        return nil, err
+    }
+
+    c := defaultConfig()
+    if *configPath != "" {
+        b, err := ioutil.ReadFile(*configPath)
+        if err != nil {
+            return nil, err
+        }
+        dec := json.NewDecoder(bytes.NewReader(b))
+        dec.DisallowUnknownFields()         // catches misspelt keys
+        if err := dec.Decode(c); err != nil {
+            return nil, fmt.Errorf("config file %v - %v", *configPath, err)
+        }
+    }
+
+    fields := c.fields()
+    for _, f := range fields {
+        env := "UBER_" + strings.ToUpper(f.key)
+        if v := getenv(env); v != "" {
+            if err := setConfigValue(f.ptr, v); err != nil {
+                return nil, fmt.Errorf("env var %v - %v", env, err)
+            }
+        }
+    }
+
+    flaggedFields := flagged.fields()
+    fs.Visit(func(fl *flag.Flag) {
+        for i, f := range flaggedFields {
+            if fl.Name == strings.Replace(f.key, "_", "-", -1) {
+                copyConfigValue(fields[i].ptr, f.ptr)
+            }
+        }
+    })
+
+    if err := c.validate(); err != nil {
+        return nil, err
+    }
+    return c, nil
+}
+
+/* Checks that params make sense together
+ */
+func (c *Config) validate() error {
+    var errs []string
+    check := func(ok bool, msg string) {
+        if !ok {
+            errs = append(errs, msg)
+        }
+    }
+
+    check(c.ListenAddr != "", "listen_addr should not be empty")
+    _, known := parseLogLevel(c.LogLevel)
+    check(known, "log_level should be one of debug, info, warn or error")
+    check(c.LogFormat == "text" || c.LogFormat == "json", "log_format should be text or json")
+    check(c.SlowRequestMs >= 1, "slow_request_ms should be at least 1")
+    check(c.DriverIdMode == DRIVER_IDS_REGISTRY || c.DriverIdMode == DRIVER_IDS_RANGE,
+            "driver_id_mode should be registry or range")
+    check(c.MinDriverId >= 1, "min_driver_id should be at least 1")
+    check(c.MaxDriverId >= c.MinDriverId, "max_driver_id should not be less than min_driver_id")
+    check(c.Radius > 0, "radius should be positive")
+    check(c.Limit >= 1 && c.Limit <= c.MaxDriverId, "limit should be between 1 and max_driver_id")
+    check(c.MaxWorkers >= 1, "max_workers should be at least 1")
+    check(c.MaxQueue >= 1, "max_queue should be at least 1")
+    check(c.RetryAfterSec >= 1, "retry_after_sec should be at least 1")
+    check(c.MaxBatchItems >= 1, "max_batch_items should be at least 1")
+    check(c.MaxBatchBytes >= 1, "max_batch_bytes should be at least 1")
+    check(c.MaxClockSkewMs >= 0, "max_clock_skew_ms should not be negative")
+    check(c.ReadyQueueFillPct >= 1 && c.ReadyQueueFillPct <= 100, "ready_queue_fill_pct should be between 1 and 100")
+    _, known = stores[c.Store]
+    check(known, "store should be one of registered stores, not '" + c.Store + "'")
+    check(c.SnapshotIntervalSec >= 1, "snapshot_interval_sec should be at least 1")
+    /* write-ahead log is compacted into the snapshot, and would grow without bound otherwise */
+    check(c.SnapshotPath != "" || (c.Store != STORE_IN_MEMORY && c.WalDir == ""),
+            "snapshot_path should not be empty for memory store or with wal_dir set")
+    check(c.WalSyncIntervalMs >= 1, "wal_sync_interval_ms should be at least 1")
+    check(c.DriverTTLSec >= 1, "driver_ttl_sec should be at least 1")
+    check(c.SweepIntervalSec >= 1, "sweep_interval_sec should be at least 1")
+    check(c.HistoryPoints >= 0, "history_points should not be negative")
+    check(c.HistoryMaxAgeSec >= 1, "history_max_age_sec should be at least 1")
+    check(c.HistoryMaxTotalPoints >= 1, "history_max_total_points should be at least 1")
+    check(c.ReadyDrainSec >= 0, "ready_drain_sec should not be negative")
+    check(c.ShutdownTimeoutSec >= 1, "shutdown_timeout_sec should be at least 1")
+
+    if len(errs) > 0 {
+        return errors.New("invalid config - " + strings.Join(errs, "; "))
+    }
+    return nil
+}
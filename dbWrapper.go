@@ -6,151 +6,234 @@ package main
  * one can call same api(s) irrespective of the configured DB
  * (like mysql or in memory, etc). The wrapper should translate
  * to exact read and write call for configured DB.
+ *
+ * Every database implements the Store interface and registers
+ * itself by name from its init(). The one named by Config.Store
+ * is picked in initDB() and rest of the code only talks to it
+ * through the package level 'db'.
  */
 
 import (
-    "os"
+    "container/heap"
+    "context"
+    "errors"
     "log"
     "math"
-    "encoding/json"
+    "sync/atomic"
+    "time"
 )
 
+/* Store is implemented by every database that can hold driver details
+ */
+type Store interface {
+    /* Prepares the store for use, like connecting or creating schema */
+    Init() error
+
+    /* Inserts the driver record or updates its location if already present.
+     * Returns errStaleUpdate, leaving the record as is, if the present one
+     * has a later Timestamp. Status is kept as is if empty in d, and set to
+     * STATUS_AVAILABLE for a new driver. A status change not allowed by
+     * canTransition() from the stored one, which may have changed since the
+     * update was queued, is left out while the location is still applied,
+     * and errBadTransition returned. In DRIVER_IDS_REGISTRY mode, an update
+     * of a driver whose profile is deactivated is refused with
+     * errDriverInactive, checked under the same lock as the write */
+    Upsert(d DriverStore) error
+
+    /* Removes location of driver id from searches right away, keeping its
+     * Timestamp and setting RemovedAt to server time 'at'. Updates taken no
+     * later than Timestamp, on the clock of the device, or received by the
+     * server no later than RemovedAt, like one still queued when the removal
+     * was applied, are refused with errStaleUpdate afterwards.
+     * Returns false if there was no location */
+    RemoveLocation(id float64, at int64) (bool, error)
+
+    /* Changes status of a driver if allowed by canTransition(); returns the
+     * status before the change, errBadTransition or errDriverNotFound */
+    SetStatus(id float64, status DriverStatus) (DriverStatus, error)
+
+    /* Registers vehicle of driver v.Id, replacing the one registered before.
+     * The driver need not have sent a location yet */
+    SetVehicle(v Vehicle) error
+
+    /* Adds profile of a new driver to the registry; errDriverExists if id
+     * is already registered */
+    CreateProfile(p DriverProfile) error
+
+    /* Replaces profile of a registered driver; errDriverNotFound if not
+     * registered */
+    UpdateProfile(p DriverProfile) error
+
+    /* Looks up profile of a driver; false is returned if not registered */
+    GetProfile(id float64) (DriverProfile, bool, error)
+
+    /* Looks up a driver by id along with its vehicle; false is returned if
+     * not present or its location is removed */
+    Get(id float64) (DriverStore, bool, error)
+
+    /* Looks up what decides if an update of driver id is applied - its
+     * Timestamp, Status, Removed and RemovedAt - also when its location is removed;
+     * false is returned if not present */
+    GetState(id float64) (DriverStore, bool, error)
+
+    /* Returns at max v["lim"] drivers nearest to v["lat"], v["lon"] within v["rad"]
+     * meters, sorted by ascending distance which is set in AccOrDist.
+     * Drivers with ReceivedAt older than v["since"] are left out, and so are
+     * the ones with status not in mask v["status"], if set, and the ones whose
+     * vehicle does not match the filters, see vehicleMatches() */
+    Nearest(v Values) ([]DriverStore, error)
+
+    /* Removes drivers with ReceivedAt older than 'before', but not their
+     * vehicles; returns count removed */
+    Evict(before int64) (int, error)
+
+    /* Returns count of drivers in store with a location */
+    Count() (int, error)
+
+    /* Releases the store. Stores that live in memory dump their data into
+     * the snapshot file, others may ignore it */
+    Close(snapshot string) error
+}
+
+/* Returned by Store.Upsert for an update older than the stored location */
+var errStaleUpdate = errors.New("update is older than stored location")
+
+/* Tells if an update taken at timestamp ts and received at receivedAt should
+ * be refused, given the stored record. A removal wins over an update of the
+ * same millisecond, which was likely sent before it, and over one received by
+ * the server before it whatever the clock of the device says
+ */
+func isStaleUpdate(ts, receivedAt int64, stored DriverStore) bool {
+    return ts < stored.Timestamp || (stored.Removed && (ts == stored.Timestamp || receivedAt <= stored.RemovedAt))
+}
+
+/* Constructors of all known stores keyed by their name */
+var stores = make(map[string]func(cfg *Config) Store)
+
+/* Store in use, set by initDB(). Tests may replace it with their own */
+var db Store
+
+/* Makes a store available to be picked by name at startup
+ * Should be called from init() of the file implementing the store
+ */
+func registerStore(name string, newStore func(cfg *Config) Store) {
+    if _, dup := stores[name]; dup {
+        log.Panicf("Store %v registered twice", name)
+    }
+    stores[name] = newStore
+}
+
+/* Creates and initialises the store named in cfg
+ */
+func openStore(cfg *Config) (Store, error) {
+    newStore, ok := stores[cfg.Store]
+    if !ok {
+        return nil, errors.New("configured DB not supported - " + cfg.Store)
+    }
+    s := newStore(cfg)
+    if err := s.Init(); err != nil {
+        return nil, err
+    }
+    return s, nil
+}
+
 /* Initialises the configured database
  * Returns true in case of sucessful init, else returns false
  */
-func initDB() bool {
-    switch CURRENT_DB {
-        case STORE_IN_MEMORY :
-            inMemDb = make(map[float64]DriverStore)
-            return true
-        case STORE_MYSQL :
-            //TODO:
-            log.Println("Exiting: configured DB not supported!")
-            return false
-        default :
-            log.Println("Exiting: configured DB not supported!")
-            return false
-    }    
-}   
+func initDB(cfg *Config) bool {
+    s, err := openStore(cfg)
+    if err != nil {
+        logError("Exiting: %v", err)
+        return false
+    }
+    db = s
+    return true
+}
 
 
 /* For graceful shutdown of DB in case of stopping the application
- * 
- * Caveat : We can put logic in initDB in case of IN_MEM DBs to persist data
- * ------
- * while stopping the application so that it can be re-read
- * during application restart
- * Not doing init() with reading of data from disk as its not in scope of current activity
- *
- * But showing the writing of data for demo.
+ * Stores living in memory write their data into file 'f' so that
+ * last populated values are not lost.
+ * Returns false if the store could not be closed cleanly
  */
-func closeDB(f string) {
-    switch CURRENT_DB {
-        case STORE_IN_MEMORY :
-            // Write to disk to sustain last populated values
-            file, err := os.OpenFile(string(f), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
-            if err != nil {
-                log.Printf("Error in persisting data to file %v, got error while opening - %v", f, err)
-                return
-            }
-            for _, v := range inMemDb {
-                b, err := json.Marshal(v)
-                if _, err = file.Write(b); err != nil {
-                    log.Printf("Error in persisting Data to file %v, got - ", f, err)
-                    file.Close()
-                    return
-                }
-            }
-            if err := file.Close(); err != nil {
-                log.Printf("Error in persisting Data to file %v, got - %v", f, err)
-            }
-            return 
-        case STORE_MYSQL :
-            //TODO:
-            log.Println("Exiting: configured DB not supported!")
-            return 
-        default :
-            log.Println("Exiting: configured DB not supported!")
-            return
-    }    
+func closeDB(f string) bool {
+    if db == nil {
+        return true
+    }
+    if err := db.Close(f); err != nil {
+        logError("Error in closing DB - %v", err)
+        return false
+    }
+    return true
 }
 
 /* Wrapper for extracting nearest drivers from DB for HTTP request coordinates.
- * It calls appropriate DB wrapper based on configured DB type.
+ * It calls Nearest() on the configured store.
  * Inputs :
- *      r - Htpt request object
- *      api - represents called request
+ *      v - validated params of GET request
  * Returns :
  *      []DriverStore - array containing list of nearest drivers found
  *      string - contains the error message in case of any failure
  *      int - HTTP error code
  */
-func getNearestDrivers(v Values) ([]DriverStore, string, int) {
+func getNearestDrivers(ctx context.Context, v Values) ([]DriverStore, string, int) {
 
     /* We should avoid making full scan of DB for specified coordinates
      * We can do this by determining min/max lat/lon values based on received coordinates
-     * This would return a rectangle of diameter=2*radius around given coordinate 
+     * This would return a rectangle of diameter=2*radius around given coordinate
      * and contains nearest drivers.
      * We can then evaluate each entry in this result set to find out the drivers
      * that fall within this circle of received corrdinates as below
-     * For this, we should create two more tables in DB, one for {lat,id} and other for 
+     * For this, we should create two more tables in DB, one for {lat,id} and other for
      * {lon, id}. The commod ids can then be fetched from main table which contains
      * denormalised data(i.e. contain entire details with id)
      *
      * This implementation is good when data is saved in some external DB(like mySql)
-     * Sample Implementation :
-     * minLat, maxLat, minLon, maxLon, err := getRangeOfCoordinates(v)
+     * and is used by mysqlStore.Nearest()
      */
 
-    switch {
-        case CURRENT_DB == STORE_IN_MEMORY :
-            return getNearestDriversFromInMemStore(v)
-        default :
-            return nil, "Internal Error!", 500          // we can not mark it 4xx because its our server
-                                                        // error to NOT properly set the CURRENT_DB, 
-                                                        // it indicates that initDB() messed up
+    if db == nil {
+        return nil, "Internal Error!", 500          // we can not mark it 4xx because its our server
+                                                    // error, it indicates that initDB() messed up
     }
+
+    atomic.AddInt64(&nearestSearches, 1)
+    results, err := db.Nearest(v)
+    if err != nil {
+        logCtx(ctx, LOG_ERROR, "Error finding nearest drivers - %v", err)
+        return nil, "Internal Error!", 500
+    }
+    return results, "", 200
 }
 
-/* Wrapper for extracting nearest drivers from STORE_IN_MEMORY DB for HTTP request coordinates.
- * The fucntion iterates through all entries and calculate distance in meters with its own coordinates
- * If returned distance is less than provided radius value, it is put into a sorted set
- * A count is kept for found results and we return if the limit is met even if full scannign is not done.
- *
- * Caveat : Since requirement specifies only max "lim" coordinates within the provided radius, we are
- * not binded to find the top nearest drivers.
- *
- * Input and Return values are same as described for getNearestDrivers()
- */
-func getNearestDriversFromInMemStore(v Values) ([]DriverStore, string, int) {
-
-   /* TODO : we should handle the accuracy also by considering two values
-    * for each lat - min(=acc*lat) and max(=(1-acc)*lat). Same for lon. 
-    * This is because accuracy indicates that driver may be present anywhere
-    * within latitude/longitude range {min, max} as calculated above
-    */
-
-    la := v["lat"]
-    lo := v["lon"]
-    ra := v["rad"]
-    li := (int)(v["lim"])
-    cnt := 0
-    dis := 0.0
-    var s []DriverStore
-    var d DriverStore
-    for _, value := range inMemDb {
-        d = value
-        dis = Distance(la, lo, d.Latitude, d.Longitude)     //see above note-TODO for incorporating accuracy
-        if dis <= ra {
-            d.AccOrDist = dis        // reusing this field to return distance calculated
-            s = append(s, d)
-            cnt++
-        }
-        if cnt == li {
-            return s, "", 200
+/* Current server time in unix milliseconds, as kept in DriverStore.ReceivedAt
+ */
+func nowMillis() int64 {
+    return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+/* Evicts drivers not updated within ttl, and prunes location history, every
+ * interval till stop is closed; meant to be run as a go routine
+ */
+func runSweeper(ttl, interval time.Duration, stop <-chan bool) {
+    tick := time.NewTicker(interval)
+    defer tick.Stop()
+    for {
+        select {
+        case <-tick.C:
+            n, err := db.Evict(nowMillis() - int64(ttl/time.Millisecond))
+            if err != nil {
+                logError("Error in evicting stale drivers - %v", err)
+            } else if n > 0 {
+                logInfo("Evicted %v stale drivers", n)
+            }
+            if history != nil {
+                history.Prune(nowMillis())
+            }
+        case <-stop:
+            return
         }
     }
-    return s, "", 200
 }
 
 func Distance(lat1, lon1, lat2, lon2 float64) float64 {
@@ -162,7 +245,7 @@ func Distance(lat1, lon1, lat2, lon2 float64) float64 {
     la2 = lat2 * math.Pi / 180
     lo2 = lon2 * math.Pi / 180
 
-    r = 6378100 // Earth radius in METERS
+    r = EARTH_RADIUS // in METERS
 
     // calculate
     h := hsin(la2-la1) + math.Cos(la1)*math.Cos(la2)*hsin(lo2-lo1)
@@ -174,39 +257,125 @@ func hsin(theta float64) float64 {
     return math.Pow(math.Sin(theta/2), 2)
 }
 
-/* 
- * It calculates min amd max values for specified coordinates for 
- * shortening the scan in external DBs like mysql.
- * It is not meaningful in case of STORE_IN_MEMORY storage type.
- * 
- * Assumption : radius is already in radians (should have been converted during validation step)
+/* Max-heap of drivers on their distance(AccOrDist) so that the farthest one is
+ * on top. Equal distances are ordered on id to keep results deterministic.
+ */
+type nearestHeap []DriverStore
+
+func (h nearestHeap) Len() int      { return len(h) }
+func (h nearestHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h nearestHeap) Less(i, j int) bool {
+    if h[i].AccOrDist != h[j].AccOrDist {
+        return h[i].AccOrDist > h[j].AccOrDist
+    }
+    return h[i].Id > h[j].Id
+}
+func (h *nearestHeap) Push(x interface{}) { *h = append(*h, x.(DriverStore)) }
+func (h *nearestHeap) Pop() interface{} {
+    old := *h
+    d := old[len(old)-1]
+    *h = old[:len(old)-1]
+    return d
+}
+
+/* Collects the 'limit' nearest drivers out of any number offered to it
+ * while holding only 'limit' of them at a time. Used by stores for
+ * answering Nearest() without sorting every driver within the radius.
+ */
+type nearestCollector struct {
+    limit   int
+    h       nearestHeap
+}
+
+func newNearestCollector(limit int) *nearestCollector {
+    return &nearestCollector{limit: limit, h: make(nearestHeap, 0, limit)}
+}
+
+/* Offers a driver with its distance already set in AccOrDist
+ */
+func (c *nearestCollector) offer(d DriverStore) {
+    if c.limit <= 0 {
+        return
+    }
+    if len(c.h) < c.limit {
+        heap.Push(&c.h, d)
+        return
+    }
+    top := c.h[0]
+    if d.AccOrDist < top.AccOrDist || (d.AccOrDist == top.AccOrDist && d.Id < top.Id) {
+        c.h[0] = d
+        heap.Fix(&c.h, 0)
+    }
+}
+
+/* Returns the collected drivers nearest first
+ */
+func (c *nearestCollector) sorted() []DriverStore {
+    if len(c.h) == 0 {
+        return nil
+    }
+    s := make([]DriverStore, len(c.h))
+    for i := len(s) - 1; i >= 0; i-- {
+        s[i] = heap.Pop(&c.h).(DriverStore)
+    }
+    return s
+}
+
+/*
+ * It calculates min amd max values for specified coordinates for
+ * shortening the scan in external DBs like mysql and in the gridIndex
+ * of STORE_IN_MEMORY.
+ *
+ * Radius is in meters, on the sphere of Distance(). Latitude spans the radius
+ * as is, while the circle reaches asin(sin(r)/cos(lat)) of longitude either side,
+ * r being the radius as an angle. When the circle takes in a pole or crosses
+ * the antimeridian, whole longitude range is returned.
  */
 func getRangeOfCoordinates(v Values) (float64, float64, float64, float64){
     lat := v["lat"]
     lon := v["lon"]
-    rad := v["rad"]
+    r := v["rad"] / EARTH_RADIUS
+
+    dLat := r * 180 / math.Pi
+    min_lat := math.Max(lat - dLat, -90)
+    max_lat := math.Min(lat + dLat, 90)
 
-    min_lat := lat - rad
-    max_lat := lat + rad
-    min_lon := lon - rad
-    max_lon := lon + rad
+    min_lon, max_lon := -180.0, 180.0
+    if s, c := math.Sin(r), math.Cos(lat * math.Pi / 180); r < math.Pi / 2 && s < c {
+        dLon := math.Asin(s / c) * 180 / math.Pi
+        if lon - dLon >= -180 && lon + dLon <= 180 {
+            min_lon, max_lon = lon - dLon, lon + dLon
+        }
+    }
 
     return min_lat, max_lat, min_lon, max_lon
 }
 
 
-/* 
+/* Applies the job to configured DB, be it a location update or a change of
+ * status or removal of location
+ */
+func (v Job) apply() jobResult {
+    var res jobResult
+    switch v.Kind {
+        case WAL_STATUS:
+            res.prev, res.err = db.SetStatus(v.Payload.Id, v.Payload.Status)
+        case WAL_REMOVE:
+            res.removed, res.err = db.RemoveLocation(v.Payload.Id, v.Payload.ReceivedAt)
+        default:
+            res.err = v.WriteToDB()
+    }
+    return res
+}
+
+/*
  * This function does the writing to configured DB for received
- * record(Job)
+ * record(Job), recording it in location history once applied
  */
 func (v Job) WriteToDB() error {
-    switch {
-        case CURRENT_DB == STORE_IN_MEMORY :
-            inMemDb[v.Payload.Id] = v.Payload
-        default :
-            return  nil   
+    err := db.Upsert(v.Payload)
+    if (err == nil || err == errBadTransition) && history != nil {
+        history.Add(v.Payload)
     }
-    return nil
+    return err
 }
-
-
@@ -7,35 +7,138 @@ package main
  * It delegates these requests to one of the workers
  */ 
 
+import (
+    "context"
+    "sync/atomic"
+    "time"
+)
 
-func NewDispatcher(count int) *Dispatcher {
-    pool := make(chan chan Job, count)
-    return &Dispatcher{WorkerPool: pool, maxWorkers: count}
+func NewDispatcher(cfg *Config) *Dispatcher {
+    return &Dispatcher{
+                JobQueue:   make(chan Job, cfg.MaxQueue),
+                capacity:   int64(cfg.MaxQueue),
+                maxWorkers: cfg.MaxWorkers,
+                quit:       make(chan bool),
+            }
 }
 
 func (d *Dispatcher) Run() {
     // starting n number of workers
     for i := 0; i < d.maxWorkers; i++ {
-        worker := NewWorker(d.WorkerPool)
+        worker := NewWorker(d)
         worker.Start()
+        d.workers = append(d.workers, worker)
     }
 
     go d.dispatch()     //spawns a new thread with this routine
+    atomic.StoreInt32(&d.running, 1)
 }
 
+func (d *Dispatcher) isRunning() bool {
+    return atomic.LoadInt32(&d.running) == 1
+}
+
+/* Returns pending jobs as percent of capacity
+ */
+func (d *Dispatcher) fillPct() float64 {
+    return float64(atomic.LoadInt64(&d.pending)) * 100 / float64(d.capacity)
+}
+
+/* Returns the worker that handles every job of the driver with given id
+ */
+func (d *Dispatcher) workerOf(id float64) Worker {
+    return d.workers[uint64(id)%uint64(len(d.workers))]
+}
+
+/* Count of jobs waiting for a worker to take them up
+ */
+func (d *Dispatcher) queueDepth() int64 {
+    n := len(d.JobQueue)
+    for _, w := range d.workers {
+        n += w.Mailbox.len()
+    }
+    return int64(n)
+}
+
+/* Hands over the jobs in order of JobQueue to the Mailbox of the worker of
+ * their driver, where an update right behind another waiting one of same
+ * driver gets coalesced
+ */
 func (d *Dispatcher) dispatch() {
     for {
         select {
-        case job := <-JobQueue:
+        case job := <-d.JobQueue:
             // a job request has been received
-            go func(job Job) {
-                // try to obtain a worker job channel that is available.
-                // this will block until a worker is idle
-                jobChannel := <-d.WorkerPool
-
-                // dispatch the job to the worker job channel
-                jobChannel <- job
-            }(job)
+            if left, ok := d.workerOf(job.Payload.Id).Mailbox.put(job); ok {
+                atomic.AddInt64(&d.coalesced, 1)
+                d.applied(left)
+            }
+
+        case <-d.quit:
+            return
         }
     }
 }
+
+/* Stop waits till every queued job has been applied by the workers and
+ * then stops the dispatcher and all its workers.
+ * No more jobs should be queued once Stop is called, i.e. HTTP server
+ * should already be shut down.
+ * If ctx expires first, its error is returned leaving the remaining jobs
+ * and workers running.
+ */
+func (d *Dispatcher) Stop(ctx context.Context) error {
+    tick := time.NewTicker(10 * time.Millisecond)
+    defer tick.Stop()
+    for atomic.LoadInt64(&d.pending) > 0 {
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-tick.C:
+        }
+    }
+
+    atomic.StoreInt32(&d.running, 0)
+    close(d.quit)
+    for _, w := range d.workers {
+        w.Stop()
+    }
+    return nil
+}
+
+/* Queues the job for the dispatcher without blocking, after appending it
+ * to the write-ahead log if one is in use. Jobs of a driver reach its worker
+ * in order of the log, so that replay applies them in the same order.
+ * Returns false, leaving the job out, if capacity jobs are already pending.
+ */
+func (d *Dispatcher) Submit(job Job) bool {
+    if atomic.AddInt64(&d.pending, 1) > d.capacity {
+        atomic.AddInt64(&d.pending, -1)
+        return false
+    }
+
+    d.submitMu.Lock()
+    defer d.submitMu.Unlock()
+    if wal != nil {
+        seg, err := wal.Append(job.Kind, job.Payload)
+        if err != nil {
+            logCtx(job.ctx, LOG_ERROR, "Error appending to write-ahead log: %s", err.Error())
+        } else {
+            job.walSeg = seg
+        }
+    }
+
+    /* never blocks as JobQueue can hold capacity jobs */
+    d.JobQueue <- job
+    return true
+}
+
+/* Marks a queued job as done with, so that Stop does not wait for it
+ * anymore and its part of write-ahead log can be compacted
+ */
+func (d *Dispatcher) applied(j Job) {
+    atomic.AddInt64(&d.pending, -1)
+    if j.walSeg != nil {
+        j.walSeg.pending.Done()
+    }
+}
@@ -0,0 +1,102 @@
+package main
+
+/*
+ * Driver status and the changes allowed between them -
+ *
+ *      available ---> on_trip ---> available
+ *      available ---> offline ---> available
+ *
+ * A driver on trip has to finish it before going offline, and an offline
+ * driver has to be available before taking a trip. Setting the current
+ * status again is always allowed.
+ * A driver is available when first seen.
+ *
+ * Searches take the statuses to include as a bit mask in Values["status"],
+ * as Values only holds float64s.
+ */
+
+import (
+    "errors"
+    "strings"
+)
+
+/* Every status, in order of their bits in a mask */
+var driverStatuses = []DriverStatus{STATUS_AVAILABLE, STATUS_ON_TRIP, STATUS_OFFLINE}
+
+var statusTransitions = map[DriverStatus][]DriverStatus{
+    STATUS_AVAILABLE: {STATUS_ON_TRIP, STATUS_OFFLINE},
+    STATUS_ON_TRIP:   {STATUS_AVAILABLE},
+    STATUS_OFFLINE:   {STATUS_AVAILABLE},
+}
+
+/* Returned by Store.SetStatus for a change not allowed from current status,
+ * and by Store.Upsert which leaves such a change out */
+var errBadTransition = errors.New("status change not allowed")
+
+/* Returned by Store.SetStatus for a driver not in store */
+var errDriverNotFound = errors.New("driver not found")
+
+/* Returns the status with given name; false if there is none
+ */
+func parseDriverStatus(name string) (DriverStatus, bool) {
+    for _, s := range driverStatuses {
+        if string(s) == name {
+            return s, true
+        }
+    }
+    return "", false
+}
+
+/* Tells if a driver can change from status 'from' to 'to'
+ */
+func canTransition(from, to DriverStatus) bool {
+    if from == to {
+        return true
+    }
+    for _, s := range statusTransitions[from] {
+        if s == to {
+            return true
+        }
+    }
+    return false
+}
+
+/* Returns the bit of status s in a mask, 0 for an unknown one
+ */
+func statusBit(s DriverStatus) float64 {
+    for i, st := range driverStatuses {
+        if st == s {
+            return float64(int(1) << uint(i))
+        }
+    }
+    return 0
+}
+
+/* Returns the status whose bit is b
+ */
+func statusOfBit(b float64) DriverStatus {
+    for _, s := range driverStatuses {
+        if statusBit(s) == b {
+            return s
+        }
+    }
+    return ""
+}
+
+/* Tells if status s is in mask; a mask of 0 takes in every status
+ */
+func statusInMask(s DriverStatus, mask float64) bool {
+    return mask == 0 || int(statusBit(s))&int(mask) != 0
+}
+
+/* Returns the statuses in mask as comma separated names, for SQL FIND_IN_SET()
+ */
+func statusNames(mask float64) string {
+    var names []string
+    for _, s := range driverStatuses {
+        if statusInMask(s, mask) {
+            names = append(names, string(s))
+        }
+    }
+    return strings.Join(names, ",")
+}
@@ -0,0 +1,228 @@
+package main
+
+/*
+ * Stand-in for a MySQL server registered with database/sql as "fakesql".
+ * It keeps the tables in memory and understands only the statements
+ * issued from mysqlStore.go, which lets STORE_MYSQL be tested without
+ * any live service.
+ * Every DSN opens its own fresh database.
+ */
+
+import (
+    "database/sql"
+    "database/sql/driver"
+    "errors"
+    "io"
+    "strings"
+    "sync"
+)
+
+func init() {
+    sql.Register("fakesql", &fakeSqlDriver{dbs: make(map[string]*fakeSqlDb)})
+}
+
+type fakeSqlDriver struct {
+    mu  sync.Mutex
+    dbs map[string]*fakeSqlDb
+}
+
+type fakeSqlDb struct {
+    mu       sync.Mutex
+    created  bool
+    drivers  map[int64][]driver.Value   // id -> values of sqlDriverFields
+    vehicles map[int64][]driver.Value   // id -> id, class, seats, features
+    profiles map[int64][]driver.Value   // id -> values of sqlProfileColumns
+}
+
+/* Returns driver row r joined with its vehicle, as in sqlDriverColumns
+ */
+func (fdb *fakeSqlDb) joined(r []driver.Value) []driver.Value {
+    row := append([]driver.Value{}, r[:7]...)
+    if v, ok := fdb.vehicles[r[0].(int64)]; ok {
+        return append(row, v[1:]...)
+    }
+    return append(row, nil, nil, nil)
+}
+
+func (fd *fakeSqlDriver) Open(dsn string) (driver.Conn, error) {
+    fd.mu.Lock()
+    defer fd.mu.Unlock()
+    db, ok := fd.dbs[dsn]
+    if !ok {
+        db = &fakeSqlDb{drivers: make(map[int64][]driver.Value), vehicles: make(map[int64][]driver.Value),
+                            profiles: make(map[int64][]driver.Value)}
+        fd.dbs[dsn] = db
+    }
+    return &fakeSqlConn{db: db}, nil
+}
+
+type fakeSqlConn struct {
+    db *fakeSqlDb
+}
+
+func (c *fakeSqlConn) Prepare(query string) (driver.Stmt, error) {
+    return &fakeSqlStmt{db: c.db, query: query}, nil
+}
+
+func (c *fakeSqlConn) Close() error              { return nil }
+func (c *fakeSqlConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *fakeSqlConn) Commit() error             { return nil }
+func (c *fakeSqlConn) Rollback() error           { return nil }
+
+type fakeSqlStmt struct {
+    db    *fakeSqlDb
+    query string
+}
+
+func (s *fakeSqlStmt) Close() error  { return nil }
+func (s *fakeSqlStmt) NumInput() int { return -1 }
+
+func (s *fakeSqlStmt) Exec(args []driver.Value) (driver.Result, error) {
+    fdb := s.db
+    fdb.mu.Lock()
+    defer fdb.mu.Unlock()
+
+    switch s.query {
+        case sqlCreateDrivers:
+            fdb.created = true
+            return driver.RowsAffected(0), nil
+        case sqlCreateVehicles, sqlCreateProfiles:
+            return driver.RowsAffected(0), nil
+        case sqlInsertProfile:
+            if _, ok := fdb.profiles[args[0].(int64)]; ok {
+                return driver.RowsAffected(0), nil
+            }
+            fdb.profiles[args[0].(int64)] = args
+            return driver.RowsAffected(1), nil
+        case sqlUpdateProfile:
+            r, ok := fdb.profiles[args[4].(int64)]
+            if !ok {
+                return driver.RowsAffected(0), nil
+            }
+            r[1], r[2], r[3], r[5] = args[0], args[1], args[2], args[3]
+            return driver.RowsAffected(1), nil
+        case sqlUpsertVehicle:
+            fdb.vehicles[args[0].(int64)] = args
+            return driver.RowsAffected(1), nil
+        case sqlUpsertDriver:
+            if !fdb.created {
+                return nil, errors.New("fakesql: table drivers does not exist")
+            }
+            fdb.drivers[args[0].(int64)] = args
+            return driver.RowsAffected(1), nil
+        case sqlRemoveLocation:
+            r, ok := fdb.drivers[args[1].(int64)]
+            if !ok || r[7].(bool) {
+                return driver.RowsAffected(0), nil
+            }
+            r[7], r[8] = true, args[0]
+            return driver.RowsAffected(1), nil
+        case sqlSetDriverStatus:
+            r, ok := fdb.drivers[args[1].(int64)]
+            if !ok {
+                return driver.RowsAffected(0), nil
+            }
+            r[6] = args[0]
+            return driver.RowsAffected(1), nil
+        case sqlEvictDrivers:
+            n := 0
+            for id, r := range fdb.drivers {
+                if r[4].(int64) < args[0].(int64) {
+                    delete(fdb.drivers, id)
+                    n++
+                }
+            }
+            return driver.RowsAffected(n), nil
+    }
+    return nil, errors.New("fakesql: unsupported statement - " + s.query)
+}
+
+func (s *fakeSqlStmt) Query(args []driver.Value) (driver.Rows, error) {
+    fdb := s.db
+    fdb.mu.Lock()
+    defer fdb.mu.Unlock()
+
+    switch s.query {
+        case sqlDriverById:
+            rows := &fakeSqlRows{cols: fakeSqlDriverColumns}
+            if r, ok := fdb.drivers[args[0].(int64)]; ok && !r[7].(bool) {
+                rows.data = append(rows.data, fdb.joined(r))
+            }
+            return rows, nil
+        case sqlLockProfile, sqlProfileById:
+            rows := &fakeSqlRows{cols: strings.Split(strings.Replace(sqlProfileColumns, " ", "", -1), ",")}
+            if s.query == sqlLockProfile {
+                rows.cols = rows.cols[:1]
+            }
+            if r, ok := fdb.profiles[args[0].(int64)]; ok {
+                rows.data = append(rows.data, r[:len(rows.cols)])
+            }
+            return rows, nil
+        case sqlProfileActive:
+            rows := &fakeSqlRows{cols: []string{"active"}}
+            if r, ok := fdb.profiles[args[0].(int64)]; ok {
+                rows.data = append(rows.data, r[3:4])
+            }
+            return rows, nil
+        case sqlCountDrivers:
+            n := int64(0)
+            for _, r := range fdb.drivers {
+                if !r[7].(bool) {
+                    n++
+                }
+            }
+            return &fakeSqlRows{cols: []string{"count"}, data: [][]driver.Value{{n}}}, nil
+        case sqlDriverState, sqlLockDriver:
+            rows := &fakeSqlRows{cols: []string{"timestamp", "status", "removed", "removed_at"}}
+            if r, ok := fdb.drivers[args[0].(int64)]; ok {
+                rows.data = append(rows.data, r[5:9])
+            }
+            return rows, nil
+        case sqlDriversInBox:
+            minLat, maxLat := args[0].(float64), args[1].(float64)
+            minLon, maxLon := args[2].(float64), args[3].(float64)
+            since := args[4].(int64)
+            statuses := "," + args[5].(string) + ","
+            class, classes := args[6].(int64), "," + args[7].(string) + ","
+            seats, features := args[8].(int64), args[10].(int64)
+            rows := &fakeSqlRows{cols: fakeSqlDriverColumns}
+            for _, r := range fdb.drivers {
+                lat, lon := r[1].(float64), r[2].(float64)
+                if !(lat >= minLat && lat <= maxLat && lon >= minLon && lon <= maxLon && r[4].(int64) >= since &&
+                        !r[7].(bool) && strings.Contains(statuses, "," + r[6].(string) + ",")) {
+                    continue
+                }
+                j := fdb.joined(r)
+                if (class != 0 || seats != 0 || features != 0) && j[7] == nil {
+                    continue        // NULLs of unregistered vehicle fail every filter
+                }
+                if class != 0 && !strings.Contains(classes, "," + j[7].(string) + ",") ||
+                        seats != 0 && j[8].(int64) < seats || features != 0 && j[9].(int64) & features != features {
+                    continue
+                }
+                rows.data = append(rows.data, j)
+            }
+            return rows, nil
+    }
+    return nil, errors.New("fakesql: unsupported query - " + s.query)
+}
+
+var fakeSqlDriverColumns = strings.Split(strings.Join(strings.Fields(sqlDriverColumns), ""), ",")
+
+type fakeSqlRows struct {
+    cols []string
+    data [][]driver.Value
+    pos  int
+}
+
+func (r *fakeSqlRows) Columns() []string { return r.cols }
+func (r *fakeSqlRows) Close() error      { return nil }
+
+func (r *fakeSqlRows) Next(dest []driver.Value) error {
+    if r.pos >= len(r.data) {
+        return io.EOF
+    }
+    copy(dest, r.data[r.pos])
+    r.pos++
+    return nil
+}
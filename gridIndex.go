@@ -0,0 +1,107 @@
+package main
+
+/*
+ * Spatial index for STORE_IN_MEMORY.
+ * Earth is divided into a uniform lat/lon grid of GRID_CELL_DEGREES sized
+ * cells and every cell keeps the ids of drivers currently inside it.
+ * A radius search then only visits the cells overlapping the bounding box
+ * of the search circle instead of every driver in the store.
+ *
+ * Not safe for concurrent use; callers should guard it along with the
+ * data it indexes.
+ */
+
+import (
+    "math"
+)
+
+type gridCell struct {
+    lat int32
+    lon int32
+}
+
+type gridIndex struct {
+    cellDeg float64
+    cells   map[gridCell]map[float64]struct{}
+}
+
+func newGridIndex(cellDeg float64) *gridIndex {
+    return &gridIndex{cellDeg: cellDeg, cells: make(map[gridCell]map[float64]struct{})}
+}
+
+func (g *gridIndex) cellOf(lat, lon float64) gridCell {
+    return gridCell{lat: int32(math.Floor(lat/g.cellDeg)), lon: int32(math.Floor(lon/g.cellDeg))}
+}
+
+/* Adds the driver at given coordinates
+ */
+func (g *gridIndex) add(id, lat, lon float64) {
+    c := g.cellOf(lat, lon)
+    ids, ok := g.cells[c]
+    if !ok {
+        ids = make(map[float64]struct{})
+        g.cells[c] = ids
+    }
+    ids[id] = struct{}{}
+}
+
+/* Removes the driver indexed at given coordinates. Empty cells are
+ * dropped so that memory follows the drivers and not the area covered.
+ */
+func (g *gridIndex) remove(id, lat, lon float64) {
+    c := g.cellOf(lat, lon)
+    ids, ok := g.cells[c]
+    if !ok {
+        return
+    }
+    delete(ids, id)
+    if len(ids) == 0 {
+        delete(g.cells, c)
+    }
+}
+
+/* Moves the driver from old coordinates to new ones; nothing is done
+ * while driver stays within the same cell
+ */
+func (g *gridIndex) move(id, oldLat, oldLon, lat, lon float64) {
+    if g.cellOf(oldLat, oldLon) == g.cellOf(lat, lon) {
+        return
+    }
+    g.remove(id, oldLat, oldLon)
+    g.add(id, lat, lon)
+}
+
+/* Calls fn for every driver in cells overlapping the given box. fn may
+ * return false to stop the visit.
+ * For very large boxes, walking the occupied cells is cheaper than
+ * walking every cell of the box, so the smaller of the two is picked.
+ */
+func (g *gridIndex) visit(minLat, maxLat, minLon, maxLon float64, fn func(id float64) bool) {
+    lo := g.cellOf(minLat, minLon)
+    hi := g.cellOf(maxLat, maxLon)
+    boxCells := (float64(hi.lat-lo.lat) + 1) * (float64(hi.lon-lo.lon) + 1)
+
+    if boxCells > float64(len(g.cells)) {
+        for c, ids := range g.cells {
+            if c.lat < lo.lat || c.lat > hi.lat || c.lon < lo.lon || c.lon > hi.lon {
+                continue
+            }
+            for id := range ids {
+                if !fn(id) {
+                    return
+                }
+            }
+        }
+        return
+    }
+
+    for la := lo.lat; la <= hi.lat; la++ {
+        for ln := lo.lon; ln <= hi.lon; ln++ {
+            for id := range g.cells[gridCell{lat: la, lon: ln}] {
+                if !fn(id) {
+                    return
+                }
+            }
+        }
+    }
+}
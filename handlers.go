@@ -5,11 +5,11 @@ package main
  */
 
 import (
-    "fmt"
-    "log"
+    "math"
     "net/http"
     "encoding/json"
-    //"strconv"
+    "strconv"
+    "sync/atomic"
 )
 
 /* Sets the received error string in http response writer as Json
@@ -20,10 +20,16 @@ import (
  *      None
  */      
 func setHttpErrorWithJson(w http.ResponseWriter, err string, errCode int) {
-    /* convert the error message to JSON for reply */
-    msg, e := json.Marshal(&makeError{Mesg : []string{err}})
+    setHttpErrorsWithJson(w, []string{err}, errCode)
+}
+
+/* Same as setHttpErrorWithJson() for more than one error message
+ */
+func setHttpErrorsWithJson(w http.ResponseWriter, errs []string, errCode int) {
+    /* convert the error messages to JSON for reply */
+    msg, e := json.Marshal(&makeError{Mesg : errs})
     if e != nil {
-        log.Printf("Error: %s", e)
+        logError("Error: %s", e)
     }
     http.Error(w, string(msg), errCode)
 }
@@ -36,15 +42,18 @@ func setHttpErrorWithJson(w http.ResponseWriter, err string, errCode int) {
  * Returns :
  *      None
  */
-func getDrivers(w http.ResponseWriter, r *http.Request) {
+func (a *App) getDrivers(w http.ResponseWriter, r *http.Request) {
 
     /* Validate query parameters as per given requirement */
-    vs, errStr, errCode := validateParams(r, GetDrivers)
+    vs, errStr, errCode := validateParams(r, GetDrivers, a.cfg)
     if len(errStr) > 0 {
         setHttpErrorWithJson(w, errStr, errCode)
         return
     }
 
+    /* drivers who stopped sending updates should not be offered to customers */
+    vs.Add("since", float64(nowMillis() - int64(a.cfg.DriverTTLSec)*1000))
+
     /* READ Latency : Since reads are comparatively faster than
      * writes, we are directly quering the DB for this request
      * Reads are easy to optimize with latest DBs(sql/nosql) 
@@ -57,57 +66,398 @@ func getDrivers(w http.ResponseWriter, r *http.Request) {
      * all Driver Update requests should get complete
      * by this time. 
      */
-    results, errStr, errCode := getNearestDrivers(vs)
+    results, errStr, errCode := getNearestDrivers(r.Context(), vs)
     if len(errStr) > 0 {
         setHttpErrorWithJson(w, errStr, errCode)
         return
     }
 
-    /* convert results into JSON before sending in response */
-    var resp []string 
-    for _, r := range results {
-        val, err := json.Marshal(r)
-        if err != nil {
-            log.Printf("Error: %s", err)
-            setHttpErrorWithJson(w, "Internal error", 500)
-            return;
-        }
-        resp = append(resp, string(val))
+    /* convert results into the documented wire type; an empty
+     * result should still be a valid JSON array */
+    now := nowMillis()
+    resp := make([]DriverResp, 0, len(results))
+    for _, d := range results {
+        resp = append(resp, DriverResp{
+                            Id:         int(d.Id),
+                            Latitude:   d.Latitude,
+                            Longitude:  d.Longitude,
+                            Distance:   int(math.Floor(d.AccOrDist + 0.5)),     // integer meters
+                            Age:        int((now - d.ReceivedAt) / 1000),
+                            Status:     string(d.Status),
+                            Vehicle:    vehicleResp(d.Vehicle),
+                        })
     }
 
-    fmt.Fprint(w, resp) 
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(resp); err != nil {
+        logCtx(r.Context(), LOG_ERROR, "Error: %s", err)
+    }
 }
 
 
 /* Http Handler for 'PUT /drivers/{id}/location' requests 
+ * An update older than the stored location gets 200 with DriverUpdateResp
+ * telling it was ignored
  * Inputs :
  *      w - writer for response
  *      r - HTTP request object
  * Returns :
  *      None
  */
-func putDriver(w http.ResponseWriter, r *http.Request) {
+func (a *App) putDriver(w http.ResponseWriter, r *http.Request) {
 
     /* Validate params */
-    vs, errStr, errCode := validateParams(r, PutDriver)
+    vs, errStr, errCode := validateParams(r, PutDriver, a.cfg)
+    var stored int64
+    if len(errStr) == 0 {
+        stored, errStr, errCode = a.submitLocation(r, vs, nowMillis())
+    }
+    if errCode == http.StatusServiceUnavailable {
+        w.Header().Set("Retry-After", strconv.Itoa(a.cfg.RetryAfterSec))
+    }
     if len(errStr) > 0 {
         setHttpErrorWithJson(w, errStr, errCode)
         return
     }
 
+    if stored != 0 {
+        resp := DriverUpdateResp{Ignored: true, Reason: "Older than stored location", StoredTimestamp: stored}
+        w.Header().Set("Content-Type", "application/json")
+        if err := json.NewEncoder(w).Encode(resp); err != nil {
+            logCtx(r.Context(), LOG_ERROR, "Error: %s", err)
+        }
+    }
+}
+
+/* Checks that the driver can send the validated update in vs and queues it
+ * for workers, as received at now and taken at device timestamp "ts" if given
+ * An update with device timestamp older than the stored location is not
+ * queued, as store would refuse it anyway. Updates queued but not yet applied
+ * are not looked at, so an older one may still pass here and be refused later.
+ * Returns Timestamp of stored location if update was ignored so, 0 otherwise;
+ * or error message and HTTP error code if it was not queued, 503 if
+ * dispatcher is full to its capacity
+ */
+func (a *App) submitLocation(r *http.Request, vs Values, now int64) (int64, string, int) {
+
+    if errStr, errCode := a.checkDriver(r, vs["id"]); len(errStr) > 0 {
+        return 0, errStr, errCode
+    }
+    timestamp := now
+    ts, hasTs := vs["ts"]
+    if hasTs {
+        timestamp = int64(ts)
+    }
+
+    /* A status change in body is checked here against the stored status, as
+     * the update is applied later by a worker with nobody left to tell
+     */
+    status := statusOfBit(vs["status"])
+    if status != "" || hasTs {
+        /* a removed location still refuses older updates, so it is looked up too */
+        old, found, err := db.GetState(vs["id"])
+        if err != nil {
+            logCtx(r.Context(), LOG_ERROR, "Error getting driver - %v", err)
+            return 0, "Internal Server Error", http.StatusInternalServerError
+        }
+        if found && isStaleUpdate(timestamp, now, old) {
+            atomic.AddInt64(&staleUpdates, 1)
+            return old.Timestamp, "", 200
+        }
+        if found && status != "" && !canTransition(old.Status, status) {
+            return 0, "Can not change status from " + string(old.Status) + " to " + string(status),
+                        http.StatusConflict
+        }
+    }
+
     /* Send request to dispatcher on channel that dispatcher is listening to
      */
-    payload := DriverStore{Id: vs["id"], Latitude: vs["lat"], Longitude: vs["lon"], AccOrDist: vs["acc"]}
-    work := Job{Payload: payload} 
-    select {
-        case JobQueue <- work :
-            //fmt.Printf("Successfully dispatched %v\n", work)
-        default :
-            /* this case ensures that this thread does not block on JobQueue in case its full to its capacity
-             */
-            setHttpErrorWithJson(w, "Server overloaded. Try after sometime.", 513)
+    payload := DriverStore{Id: vs["id"], Latitude: vs["lat"], Longitude: vs["lon"], AccOrDist: vs["acc"],
+                            ReceivedAt: now, Timestamp: timestamp, Status: status}
+    work := Job{Payload: payload, ctx: detachContext(r.Context())} 
+
+    /* Submit ensures that this thread does not block in case dispatcher is full to its capacity
+     */
+    if ok := a.dispatcher.Submit(work); !ok {
+        return 0, "Server overloaded. Try after sometime.", http.StatusServiceUnavailable
+    }
+    return 0, "", 200
+}
+
+/* Handler for 'POST /drivers/locations', letting a fleet gateway send many
+ * locations in one request. Each item is checked and queued as if it was a
+ * PUT of its own; a rejected one does not stop the others. Responds 200
+ * with result of every item, or an error if the body itself is not valid.
+ * Retry-After is set if any item was refused for overload
+ */
+func (a *App) postDriverLocations(w http.ResponseWriter, r *http.Request) {
+
+    items, errStr, errCode := validateBatchParams(w, r, a.cfg)
+    if len(errStr) > 0 {
+        setHttpErrorWithJson(w, errStr, errCode)
+        return
+    }
+
+    now := nowMillis()
+    resp := BatchResp{Results: make([]BatchItemResp, len(items))}
+    for i, raw := range items {
+        vs, errStr, errCode := validateBatchItem(raw, a.cfg, now)
+        var stored int64
+        if len(errStr) == 0 {
+            stored, errStr, errCode = a.submitLocation(r, vs, now)
+        }
+        resp.Results[i] = BatchItemResp{Index: i, Id: vs["id"], Code: errCode, Ignored: stored != 0, Error: errStr}
+        switch {
+            case len(errStr) > 0:
+                resp.Rejected++
+            case stored != 0:
+                resp.Ignored++
+            default:
+                resp.Accepted++
+        }
+        if errCode == http.StatusServiceUnavailable {
+            w.Header().Set("Retry-After", strconv.Itoa(a.cfg.RetryAfterSec))
+        }
+    }
+    if resp.Rejected > 0 {
+        logCtx(r.Context(), LOG_DEBUG, "Rejected %d of %d items of batch", resp.Rejected, len(items))
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(resp); err != nil {
+        logCtx(r.Context(), LOG_ERROR, "Error: %s", err)
+    }
+}
+
+
+/* Http Handler for 'PUT /drivers/{id}/status' requests
+ * Unlike location updates, the change is applied before responding so that
+ * a change not allowed from current status can be refused with 409. It is
+ * applied by the worker of the driver after the updates queued before it
+ * Inputs :
+ *      w - writer for response
+ *      r - HTTP request object
+ * Returns :
+ *      None
+ */
+func (a *App) putDriverStatus(w http.ResponseWriter, r *http.Request) {
+
+    vs, errStr, errCode := validateParams(r, PutStatus, a.cfg)
+    if len(errStr) == 0 {
+        errStr, errCode = a.checkDriver(r, vs["id"])
+    }
+    if len(errStr) > 0 {
+        setHttpErrorWithJson(w, errStr, errCode)
+        return
+    }
+
+    status := statusOfBit(vs["status"])
+    res, errStr, errCode := a.applyChange(w, r, WAL_STATUS, DriverStore{Id: vs["id"], Status: status})
+    if len(errStr) > 0 {
+        setHttpErrorWithJson(w, errStr, errCode)
+        return
+    }
+    prev := res.prev
+    switch res.err {
+        case nil:
+        case errDriverNotFound:
+            setHttpErrorWithJson(w, "Driver has not sent any location yet", http.StatusNotFound)
+            return
+        case errBadTransition:
+            setHttpErrorWithJson(w, "Can not change status from " + string(prev) + " to " + string(status),
+                                    http.StatusConflict)
             return
+        default:
+            logCtx(r.Context(), LOG_ERROR, "Error setting driver status - %v", res.err)
+            setHttpErrorWithJson(w, "Internal Server Error", http.StatusInternalServerError)
+            return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    resp := DriverStatusResp{Id: int(vs["id"]), Status: string(status), Previous: string(prev)}
+    if err := json.NewEncoder(w).Encode(resp); err != nil {
+        logCtx(r.Context(), LOG_ERROR, "Error: %s", err)
     }
 }
 
 
+/* Http Handler for 'PUT /drivers/{id}/vehicle' requests
+ * Registers the vehicle, replacing any registered before, and responds with it
+ * Inputs :
+ *      w - writer for response
+ *      r - HTTP request object
+ * Returns :
+ *      None
+ */
+func (a *App) putDriverVehicle(w http.ResponseWriter, r *http.Request) {
+
+    vs, errStr, errCode := validateParams(r, PutVehicle, a.cfg)
+    if len(errStr) == 0 {
+        errStr, errCode = a.checkDriver(r, vs["id"])
+    }
+    if len(errStr) > 0 {
+        setHttpErrorWithJson(w, errStr, errCode)
+        return
+    }
+
+    veh := Vehicle{Id: vs["id"], Class: classOfBit(vs["class"]), Seats: int(vs["seats"]),
+                    Features: int(vs["features"])}
+    if err := db.SetVehicle(veh); err != nil {
+        logCtx(r.Context(), LOG_ERROR, "Error registering vehicle - %v", err)
+        setHttpErrorWithJson(w, "Internal Server Error", http.StatusInternalServerError)
+        return
+    }
+    logChange(r.Context(), WAL_VEHICLE, veh)
+
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(vehicleResp(&veh)); err != nil {
+        logCtx(r.Context(), LOG_ERROR, "Error: %s", err)
+    }
+}
+
+
+/* Http Handler for 'GET /drivers/{id}', telling where the driver was last seen
+ * Inputs :
+ *      w - writer for response
+ *      r - HTTP request object
+ * Returns :
+ *      None
+ */
+func (a *App) getDriver(w http.ResponseWriter, r *http.Request) {
+
+    vs, errStr, errCode := validateParams(r, GetDriver, a.cfg)
+    if len(errStr) > 0 {
+        setHttpErrorWithJson(w, errStr, errCode)
+        return
+    }
+
+    d, found, err := db.Get(vs["id"])
+    if err != nil {
+        logCtx(r.Context(), LOG_ERROR, "Error getting driver - %v", err)
+        setHttpErrorWithJson(w, "Internal Server Error", http.StatusInternalServerError)
+        return
+    }
+    if !found {
+        setHttpErrorWithJson(w, "No location of driver", http.StatusNotFound)
+        return
+    }
+
+    resp := DriverDetailResp{
+                Id:         int(d.Id),
+                Latitude:   d.Latitude,
+                Longitude:  d.Longitude,
+                Accuracy:   d.AccOrDist,
+                Timestamp:  d.Timestamp,
+                ReceivedAt: d.ReceivedAt,
+                Age:        int((nowMillis() - d.ReceivedAt) / 1000),
+                Status:     string(d.Status),
+                Vehicle:    vehicleResp(d.Vehicle),
+            }
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(resp); err != nil {
+        logCtx(r.Context(), LOG_ERROR, "Error: %s", err)
+    }
+}
+
+
+/* Http Handler for 'GET /drivers/{id}/trail', giving locations of a driver
+ * kept in history for a time range, as JSON or as GeoJSON LineString
+ * Inputs :
+ *      w - writer for response
+ *      r - HTTP request object
+ * Returns :
+ *      None
+ */
+func (a *App) getDriverTrail(w http.ResponseWriter, r *http.Request) {
+
+    vs, errStr, errCode := validateParams(r, GetTrail, a.cfg)
+    if len(errStr) > 0 {
+        setHttpErrorWithJson(w, errStr, errCode)
+        return
+    }
+    if history == nil {
+        setHttpErrorWithJson(w, "Location history is disabled", http.StatusNotFound)
+        return
+    }
+
+    id, from, to := vs["id"], int64(vs["from"]), int64(vs["to"])
+    points := history.Trail(id, from, to)
+
+    var resp interface{}
+    if vs["geojson"] == 1 {
+        w.Header().Set("Content-Type", "application/geo+json")
+        timestamps := make([]int64, 0, len(points))
+        f := TrailFeature{Type: "Feature", Properties: map[string]interface{}{"id": int(id), "from": from, "to": to}}
+        if len(points) >= 2 {
+            f.Geometry = &LineString{Type: "LineString"}
+        }
+        for _, p := range points {
+            timestamps = append(timestamps, p.Timestamp)
+            if f.Geometry != nil {
+                f.Geometry.Coordinates = append(f.Geometry.Coordinates, [2]float64{p.Longitude, p.Latitude})
+            }
+        }
+        f.Properties["timestamps"] = timestamps
+        resp = f
+    } else {
+        w.Header().Set("Content-Type", "application/json")
+        t := TrailResp{Id: int(id), From: from, To: to, Points: make([]TrailPointResp, 0, len(points))}
+        for _, p := range points {
+            t.Points = append(t.Points, TrailPointResp{Latitude: p.Latitude, Longitude: p.Longitude,
+                                    Accuracy: p.Accuracy, Timestamp: p.Timestamp, ReceivedAt: p.ReceivedAt})
+        }
+        resp = t
+    }
+    if err := json.NewEncoder(w).Encode(resp); err != nil {
+        logCtx(r.Context(), LOG_ERROR, "Error: %s", err)
+    }
+}
+
+
+/* Http Handler for 'DELETE /drivers/{id}/location', taking the driver off
+ * searches right away, till the next location update
+ * Inputs :
+ *      w - writer for response
+ *      r - HTTP request object
+ * Returns :
+ *      None
+ */
+func (a *App) deleteDriverLocation(w http.ResponseWriter, r *http.Request) {
+
+    vs, errStr, errCode := validateParams(r, DelDriver, a.cfg)
+    if len(errStr) > 0 {
+        setHttpErrorWithJson(w, errStr, errCode)
+        return
+    }
+
+    res, errStr, errCode := a.applyChange(w, r, WAL_REMOVE, DriverStore{Id: vs["id"], ReceivedAt: nowMillis()})
+    if len(errStr) > 0 {
+        setHttpErrorWithJson(w, errStr, errCode)
+        return
+    }
+    if res.err != nil {
+        logCtx(r.Context(), LOG_ERROR, "Error removing driver location - %v", res.err)
+        setHttpErrorWithJson(w, "Internal Server Error", http.StatusInternalServerError)
+        return
+    }
+    if !res.removed {
+        setHttpErrorWithJson(w, "No location of driver", http.StatusNotFound)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+/* Queues a change of given kind of driver d.Id for the worker of the driver,
+ * behind its updates already queued, and waits till the change is applied.
+ * Keeps the store and write-ahead log in the same order of changes, see
+ * Dispatcher.Submit(). Returns error message and 503 if dispatcher is full to
+ * its capacity, setting Retry-After on w
+ */
+func (a *App) applyChange(w http.ResponseWriter, r *http.Request, kind string, d DriverStore) (jobResult, string, int) {
+    job := Job{Payload: d, Kind: kind, ctx: detachContext(r.Context()), done: make(chan jobResult, 1)}
+    if ok := a.dispatcher.Submit(job); !ok {
+        w.Header().Set("Retry-After", strconv.Itoa(a.cfg.RetryAfterSec))
+        return jobResult{}, "Server overloaded. Try after sometime.", http.StatusServiceUnavailable
+    }
+    return <-job.done, "", 200
+}
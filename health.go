@@ -0,0 +1,118 @@
+package main
+
+/*
+ * Endpoints for orchestrators and operators to probe the application -
+ *      GET /healthz    process is alive and serving HTTP
+ *      GET /readyz     application can take traffic; 503 with reasons if not
+ *      GET /status     details like workers, queue and store, as JSON
+ */
+
+import (
+    "encoding/json"
+    "net/http"
+    "sync/atomic"
+    "time"
+)
+
+/* Answers only GET and HEAD, which probes use
+ */
+func probeMethodAllowed(w http.ResponseWriter, r *http.Request) bool {
+    if r.Method != "GET" && r.Method != "HEAD" {
+        setHttpErrorWithJson(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return false
+    }
+    return true
+}
+
+/* Http Handler for 'GET /healthz'
+ * Inputs :
+ *      w - writer for response
+ *      r - HTTP request object
+ * Returns :
+ *      None
+ */
+func (a *App) healthz(w http.ResponseWriter, r *http.Request) {
+    if !probeMethodAllowed(w, r) {
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.Write([]byte(`{"status":"ok"}`))
+}
+
+/* Returns why the application should not take traffic now, empty if it can
+ */
+func (a *App) notReadyReasons() []string {
+    var reasons []string
+    if atomic.LoadInt32(&a.shuttingDown) != 0 {
+        reasons = append(reasons, "Shutting down")
+    }
+    if db == nil {
+        reasons = append(reasons, "Store not initialised")
+    }
+    if a.dispatcher == nil || !a.dispatcher.isRunning() {
+        reasons = append(reasons, "Dispatcher not running")
+    } else if fill := a.dispatcher.fillPct(); fill >= float64(a.cfg.ReadyQueueFillPct) {
+        reasons = append(reasons, "Job queue too full")
+    }
+    return reasons
+}
+
+/* Http Handler for 'GET /readyz'
+ * Inputs :
+ *      w - writer for response
+ *      r - HTTP request object
+ * Returns :
+ *      None
+ */
+func (a *App) readyz(w http.ResponseWriter, r *http.Request) {
+    if !probeMethodAllowed(w, r) {
+        return
+    }
+    if reasons := a.notReadyReasons(); len(reasons) > 0 {
+        setHttpErrorsWithJson(w, reasons, http.StatusServiceUnavailable)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.Write([]byte(`{"status":"ready"}`))
+}
+
+/* Http Handler for 'GET /status'
+ * Inputs :
+ *      w - writer for response
+ *      r - HTTP request object
+ * Returns :
+ *      None
+ */
+func (a *App) status(w http.ResponseWriter, r *http.Request) {
+    if !probeMethodAllowed(w, r) {
+        return
+    }
+
+    reasons := a.notReadyReasons()
+    resp := StatusResp{
+                Ready:          len(reasons) == 0,
+                NotReady:       reasons,
+                Store:          a.cfg.Store,
+                Drivers:        -1,
+                UptimeSec:      int64(time.Since(a.started) / time.Second),
+            }
+    if d := a.dispatcher; d != nil {
+        resp.PendingJobs = atomic.LoadInt64(&d.pending)
+        resp.Workers = len(d.workers)
+        resp.BusyWorkers = atomic.LoadInt64(&d.busy)
+        resp.QueueDepth = d.queueDepth()
+        resp.QueueCapacity = d.capacity
+    }
+    if db != nil {
+        if n, err := db.Count(); err != nil {
+            logCtx(r.Context(), LOG_ERROR, "Error counting drivers - %v", err)
+        } else {
+            resp.Drivers = n
+        }
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(resp); err != nil {
+        logCtx(r.Context(), LOG_ERROR, "Error: %s", err)
+    }
+}
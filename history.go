@@ -0,0 +1,170 @@
+package main
+
+/*
+ * Recent locations of every driver, kept in memory apart from the store which
+ * holds only the latest one. Used to give the trail of a driver, for ex. to
+ * resolve a dispute or rebuild a trip.
+ *
+ * Each driver has a ring of at most HistoryPoints locations, in the order they
+ * were applied to the store. As the store refuses updates older than the
+ * stored one, a ring is also in order of Timestamp. Points older than
+ * HistoryMaxAgeSec are pruned along with the sweep of stale drivers.
+ * Once HistoryMaxTotalPoints are held for the whole fleet, a driver's new point
+ * takes the place of its oldest one and a driver without points gets none,
+ * till pruning frees some.
+ *
+ * History is not persisted; it starts afresh with the process, apart from
+ * updates replayed from write-ahead log.
+ * Safe for concurrent use.
+ */
+
+import (
+    "sync"
+    "sync/atomic"
+)
+
+/* History in use, nil when disabled by HistoryPoints of 0 */
+var history *locationHistory
+
+/* A location in history of a driver */
+type trailPoint struct {
+    Latitude    float64
+    Longitude   float64
+    Accuracy    float64
+    Timestamp   int64
+    ReceivedAt  int64
+}
+
+/* Ring of points of a driver. Till full, points are appended; then start is
+ * the oldest one, overwritten by the next point. A ring not yet full is
+ * overwritten too while fleet limit is reached, so it is rotated to start
+ * at 0 before being appended to again
+ */
+type trail struct {
+    points  []trailPoint
+    start   int
+}
+
+type historyShard struct {
+    mu      sync.Mutex
+    trails  map[float64]*trail
+}
+
+type locationHistory struct {
+    maxPoints   int         // per driver
+    maxAge      int64       // ms
+    maxTotal    int64       // for the fleet
+    held        int64       // points held for the fleet, updated atomically
+    dropped     int64       // points not recorded as fleet limit was reached
+    shards      [MEMORY_SHARDS]historyShard
+}
+
+/* Creates history as configured, nil if it is disabled
+ */
+func newLocationHistory(cfg *Config) *locationHistory {
+    if cfg.HistoryPoints == 0 {
+        return nil
+    }
+    h := &locationHistory{maxPoints: cfg.HistoryPoints, maxAge: int64(cfg.HistoryMaxAgeSec) * 1000,
+                            maxTotal: int64(cfg.HistoryMaxTotalPoints)}
+    for i := range h.shards {
+        h.shards[i].trails = make(map[float64]*trail)
+    }
+    return h
+}
+
+func (h *locationHistory) shardOf(id float64) *historyShard {
+    return &h.shards[uint64(id) % MEMORY_SHARDS]
+}
+
+/* Records location d, just applied to store, in history of its driver
+ */
+func (h *locationHistory) Add(d DriverStore) {
+    p := trailPoint{Latitude: d.Latitude, Longitude: d.Longitude, Accuracy: d.AccOrDist,
+                        Timestamp: d.Timestamp, ReceivedAt: d.ReceivedAt}
+    s := h.shardOf(d.Id)
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    t := s.trails[d.Id]
+    switch {
+        case t != nil && len(t.points) < h.maxPoints && h.reserve():
+            if t.start != 0 {
+                rotated := make([]trailPoint, 0, len(t.points) + 1)
+                rotated = append(rotated, t.points[t.start:]...)
+                t.points, t.start = append(rotated, t.points[:t.start]...), 0
+            }
+            t.points = append(t.points, p)
+        case t != nil:
+            /* full, or fleet limit reached; the oldest point makes way */
+            t.points[t.start] = p
+            t.start = (t.start + 1) % len(t.points)
+        case h.reserve():
+            s.trails[d.Id] = &trail{points: []trailPoint{p}}
+        default:
+            atomic.AddInt64(&h.dropped, 1)
+    }
+}
+
+/* Takes room for a new point within fleet limit; false if there is none
+ */
+func (h *locationHistory) reserve() bool {
+    if atomic.AddInt64(&h.held, 1) > h.maxTotal {
+        atomic.AddInt64(&h.held, -1)
+        return false
+    }
+    return true
+}
+
+/* Returns points of driver taken from from to to, both inclusive, oldest first
+ */
+func (h *locationHistory) Trail(id float64, from, to int64) []trailPoint {
+    s := h.shardOf(id)
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    res := []trailPoint{}
+    t := s.trails[id]
+    if t == nil {
+        return res
+    }
+    for i := range t.points {
+        p := t.points[(t.start + i) % len(t.points)]
+        if p.Timestamp >= from && p.Timestamp <= to {
+            res = append(res, p)
+        }
+    }
+    return res
+}
+
+/* Drops points taken before now less HistoryMaxAgeSec, and drivers left
+ * without any. Returns count of points dropped
+ */
+func (h *locationHistory) Prune(now int64) int {
+    since := now - h.maxAge
+    n := 0
+    for i := range h.shards {
+        s := &h.shards[i]
+        s.mu.Lock()
+        for id, t := range s.trails {
+            if t.points[t.start].Timestamp >= since {
+                continue            // oldest one is recent enough
+            }
+            kept := make([]trailPoint, 0, len(t.points))
+            for j := range t.points {
+                if p := t.points[(t.start + j) % len(t.points)]; p.Timestamp >= since {
+                    kept = append(kept, p)
+                }
+            }
+            n += len(t.points) - len(kept)
+            if len(kept) == 0 {
+                delete(s.trails, id)
+            } else {
+                t.points, t.start = kept, 0
+            }
+        }
+        s.mu.Unlock()
+    }
+    atomic.AddInt64(&h.held, int64(-n))
+    return n
+}
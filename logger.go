@@ -0,0 +1,115 @@
+package main
+
+/*
+ * Levelled logging for this application.
+ * Lines go to stderr either as text, like the standard log package -
+ *      2026/01/02 15:04:05 INFO  Responded "GET /drivers" status=200 bytes=2 latency_us=250
+ * or, with log_format "json", as one JSON object per line for log pipelines -
+ *      {"time":"...","level":"info","msg":"Responded \"GET /drivers\"","status":200,...}
+ * Lines below configured log_level are dropped.
+ */
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "os"
+    "sort"
+    "strings"
+    "time"
+)
+
+type logLevel int
+const (
+    LOG_DEBUG logLevel = iota
+    LOG_INFO
+    LOG_WARN
+    LOG_ERROR
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+/* Extra key/values of a log line, like request id or status code */
+type logFields map[string]interface{}
+
+/* Destination and settings of logs, changed only by setupLogging() at startup */
+var logger = log.New(os.Stderr, "", log.LstdFlags)
+var logConfig = struct {
+    level   logLevel
+    json    bool
+    slow    time.Duration       // requests slower than it are logged as warnings
+}{level: LOG_INFO, slow: 100 * time.Millisecond}
+
+/* Returns the level with given name
+ */
+func parseLogLevel(name string) (logLevel, bool) {
+    for i, n := range logLevelNames {
+        if n == name {
+            return logLevel(i), true
+        }
+    }
+    return LOG_INFO, false
+}
+
+/* Applies the logging params of cfg, which is already validated
+ */
+func setupLogging(cfg *Config) {
+    logConfig.level, _ = parseLogLevel(cfg.LogLevel)
+    logConfig.json = cfg.LogFormat == "json"
+    logConfig.slow = time.Duration(cfg.SlowRequestMs) * time.Millisecond
+    if logConfig.json {
+        logger.SetFlags(0)          // time is a field of its own
+    } else {
+        logger.SetFlags(log.LstdFlags)
+    }
+}
+
+/* Writes a log line at given level with msg formatted as in fmt.Sprintf
+ */
+func logf(level logLevel, fields logFields, format string, args ...interface{}) {
+    if level < logConfig.level {
+        return
+    }
+    msg := fmt.Sprintf(format, args...)
+
+    if logConfig.json {
+        line := logFields{"time": time.Now().Format(time.RFC3339Nano), "level": logLevelNames[level], "msg": msg}
+        for k, v := range fields {
+            line[k] = v
+        }
+        b, err := json.Marshal(line)
+        if err != nil {
+            b, _ = json.Marshal(logFields{"level": "error", "msg": "Error in encoding log line - " + err.Error()})
+        }
+        logger.Print(string(b))
+        return
+    }
+
+    keys := make([]string, 0, len(fields))
+    for k := range fields {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    var sb strings.Builder
+    fmt.Fprintf(&sb, "%-5s %s", strings.ToUpper(logLevelNames[level]), msg)
+    for _, k := range keys {
+        fmt.Fprintf(&sb, " %s=%v", k, fields[k])
+    }
+    logger.Print(sb.String())
+}
+
+/* Writes a log line like logf() tagged with request id carried by ctx, if any
+ */
+func logCtx(ctx context.Context, level logLevel, format string, args ...interface{}) {
+    var fields logFields
+    if id := requestIdOf(ctx); id != "" {
+        fields = logFields{"request_id": id}
+    }
+    logf(level, fields, format, args...)
+}
+
+func logDebug(format string, args ...interface{}) { logf(LOG_DEBUG, nil, format, args...) }
+func logInfo(format string, args ...interface{})  { logf(LOG_INFO, nil, format, args...) }
+func logWarn(format string, args ...interface{})  { logf(LOG_WARN, nil, format, args...) }
+func logError(format string, args ...interface{}) { logf(LOG_ERROR, nil, format, args...) }
@@ -3,32 +3,130 @@ package main
 /*
  * This middleware will ensure that every request will
  * get logged.
+ *
+ * Every request gets an id, taken from X-Request-ID header if the client
+ * sent a sane one or generated otherwise. It is echoed in X-Request-ID of
+ * the response and carried in the request context, down to the Job made
+ * for it, so that log lines of async work can be traced back to the request.
  */
 
 import (
-    "log"
-    "time"
+    "context"
+    "crypto/rand"
+    "encoding/hex"
     "net/http"
+    "regexp"
+    "time"
 )
 
+const requestIdHeader = "X-Request-ID"
+
+/* Ids accepted from clients; anything else is replaced to keep logs clean */
+var rRequestId = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type contextKey int
+const requestIdKey contextKey = 0
+
+/* Returns ctx carrying given request id
+ */
+func withRequestId(ctx context.Context, id string) context.Context {
+    return context.WithValue(ctx, requestIdKey, id)
+}
+
+/* Returns the request id carried by ctx, empty if none
+ */
+func requestIdOf(ctx context.Context) string {
+    if ctx == nil {
+        return ""
+    }
+    id, _ := ctx.Value(requestIdKey).(string)
+    return id
+}
+
+/* Returns a context with only the request id of ctx, for work outliving the
+ * request like a Job, as the request context is cancelled once responded
+ */
+func detachContext(ctx context.Context) context.Context {
+    return withRequestId(context.Background(), requestIdOf(ctx))
+}
+
+/* Wraps http.ResponseWriter to capture the status code and count of bytes
+ * written by handlers, which the writer does not tell afterwards
+ */
+type responseRecorder struct {
+    http.ResponseWriter
+    status      int
+    bytes       int64
+    wroteHeader bool
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+    return &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+    if !r.wroteHeader {
+        r.status = code
+        r.wroteHeader = true
+    }
+    r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+    r.wroteHeader = true
+    n, err := r.ResponseWriter.Write(b)
+    r.bytes += int64(n)
+    return n, err
+}
+
+/* Returns a random id for tying together log lines of a request
+ */
+func newRequestId() string {
+    b := make([]byte, 8)
+    if _, err := rand.Read(b); err != nil {
+        return "-"
+    }
+    return hex.EncodeToString(b)
+}
+
 func LoggingMiddleware(next http.Handler) http.Handler {
   return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
     /* First log will ensure that transactions causing server crash, if any,
-     * gets logged
+     * gets logged. It is at debug level to not double the log volume otherwise
      */
     t := time.Now()
-    log.Printf("%v Received\t- \"%v %v %v\"", r.Host, r.Method, r.URL, r.Proto)
+    id := r.Header.Get(requestIdHeader)
+    if !rRequestId.MatchString(id) {
+        id = newRequestId()
+    }
+    w.Header().Set(requestIdHeader, id)
+    r = r.WithContext(withRequestId(r.Context(), id))
+    request := r.Method + " " + r.URL.String() + " " + r.Proto
+    logf(LOG_DEBUG, logFields{"request_id": id, "host": r.Host}, "Received %q", request)
 
     /* Call the next handler function - route() in our case */
-    next.ServeHTTP(w, r)
+    rec := newResponseRecorder(w)
+    next.ServeHTTP(rec, r)
 
-    /* Final log giving latency
+    /* Final log giving status, size and latency. Server errors and requests
+     * slower than the target are raised to get noticed
      */
     latency := time.Since(t)
-    log.Printf("%v Responded\t- \"%v %v %v\", with RespTime = %vµs", r.Host, r.Method, r.URL, r.Proto, int((latency.Nanoseconds())/10000))
+    level := LOG_INFO
+    if rec.status >= 500 {
+        level = LOG_ERROR
+    } else if rec.status >= 400 || latency > logConfig.slow {
+        level = LOG_WARN
+    }
+    logf(level, logFields{
+                    "request_id": id,
+                    "host":       r.Host,
+                    "method":     r.Method,
+                    "path":       r.URL.Path,
+                    "status":     rec.status,
+                    "bytes":      rec.bytes,
+                    "latency_us": latency.Nanoseconds() / 1000,
+                }, "Responded %q", request)
   })
 }
-
-
- 
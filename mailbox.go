@@ -0,0 +1,107 @@
+package main
+
+/*
+ * Mailbox of jobs waiting for a worker.
+ * A driver whose app reconnects can flush many locations at once, of which
+ * only the newest matters. So an update for a driver whose last waiting job
+ * is an update too replaces that one, which keeps its place in the line.
+ * A status change carried by the update left out is not lost; it moves to
+ * the kept one unless that has a status of its own.
+ * Changes of status and removals of location are never coalesced; they and
+ * the updates on either side of them wait in order of their queueing.
+ * Drivers are served in order of their first waiting job, one job at a time,
+ * so the jobs of a driver are applied in order.
+ *
+ * Safe for concurrent use.
+ */
+
+import (
+    "sync"
+)
+
+type mailbox struct {
+    mu      sync.Mutex
+    jobs    map[float64][]Job   // waiting jobs of each driver, in order
+    order   []float64           // drivers in order of their first waiting job
+    n       int                 // count of waiting jobs
+    ready   chan bool           // holds a signal once jobs are put, for the worker
+}
+
+func newMailbox() *mailbox {
+    return &mailbox{jobs: make(map[float64][]Job), ready: make(chan bool, 1)}
+}
+
+/* Puts the job in mailbox. If it is an update coalesced with a waiting one
+ * of same driver, the older of the two by Timestamp is left out and returned
+ * with true; caller should mark it applied as it will never reach the store
+ */
+func (m *mailbox) put(job Job) (Job, bool) {
+    id := job.Payload.Id
+    m.mu.Lock()
+    waiting := m.jobs[id]
+    last := len(waiting) - 1
+    if last < 0 || job.Kind != "" || waiting[last].Kind != "" {
+        if last < 0 {
+            m.order = append(m.order, id)
+        }
+        m.jobs[id] = append(waiting, job)
+        m.n++
+        m.mu.Unlock()
+        m.signal()
+        return Job{}, false
+    }
+
+    old := waiting[last]
+    if job.Payload.Timestamp < old.Payload.Timestamp {
+        if old.Payload.Status == "" {
+            waiting[last].Payload.Status = job.Payload.Status
+        }
+        m.mu.Unlock()
+        return job, true
+    }
+    if job.Payload.Status == "" {
+        job.Payload.Status = old.Payload.Status
+    }
+    waiting[last] = job
+    m.mu.Unlock()
+    m.signal()
+    return old, true
+}
+
+func (m *mailbox) signal() {
+    select {
+        case m.ready <- true :
+        default :                   // already signalled
+    }
+}
+
+/* Takes out the job at head of the line; false if mailbox is empty.
+ * A driver with more jobs waiting goes to the back of the line
+ */
+func (m *mailbox) take() (Job, bool) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if len(m.order) == 0 {
+        return Job{}, false
+    }
+    id := m.order[0]
+    m.order = m.order[1:]
+    waiting := m.jobs[id]
+    job := waiting[0]
+    if len(waiting) > 1 {
+        m.jobs[id] = waiting[1:]
+        m.order = append(m.order, id)
+    } else {
+        delete(m.jobs, id)
+    }
+    m.n--
+    return job, true
+}
+
+/* Count of jobs waiting
+ */
+func (m *mailbox) len() int {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    return m.n
+}
@@ -5,13 +5,29 @@ package main
  */
 
 import (
-    "log"
+    "context"
+    "flag"
     "os"
+    "os/signal"
+    "sync/atomic"
+    "syscall"
     "net/http"
+    "time"
 )
 
 func main() {
 
+    /* read configuration; see config.go for the sources and their precedence */
+    cfg, err := loadConfig(os.Args[1:], os.Getenv)
+    if err == flag.ErrHelp {
+        os.Exit(0)
+    }
+    if err != nil {
+        logError("Exiting: %v", err)
+        os.Exit(2)
+    }
+    setupLogging(cfg)
+
    /* create dispatcher and workers framework to process received 
     * requests asynchronously
     * We should aim to respond to HTTP requests as soon
@@ -26,7 +42,7 @@ func main() {
     * seperate request. This functionality is currently
     * not implemented in scope of current activity
     */
-    dispatcher := NewDispatcher(MAX_WORKERS)
+    dispatcher := NewDispatcher(cfg)
 
     /* call Run() on dispacher to start listening for 
      * incoming requests. All delayed processings should
@@ -35,22 +51,109 @@ func main() {
      */
     dispatcher.Run()
 
-    /* initialise DB based on configuration in models.go
+    /* initialise DB selected by configuration
      */
-    if ok := initDB(); !ok {
+    if ok := initDB(cfg); !ok {
         os.Exit(1)
     }
 
+    /* stores keeping data in memory read back their last snapshot and
+     * keep saving it periodically. A corrupt snapshot stops the start
+     * rather than letting an empty store overwrite it later
+     */
+    if err := loadSnapshot(cfg.SnapshotPath); err != nil {
+        logError("Exiting: %v", err)
+        os.Exit(1)
+    }
+
+    /* history of locations starts with updates replayed below */
+    history = newLocationHistory(cfg)
+
+    /* updates not yet in snapshot are replayed from write-ahead log,
+     * which then records every new update before it gets queued
+     */
+    stop := make(chan bool)
+    if cfg.WalDir != "" {
+        l, err := openWAL(cfg.WalDir, cfg.SnapshotPath)
+        if err != nil {
+            logError("Exiting: opening write-ahead log - %v", err)
+            os.Exit(1)
+        }
+        wal = l
+        go wal.runSync(time.Duration(cfg.WalSyncIntervalMs)*time.Millisecond, stop)
+    }
+    go runSnapshots(cfg.SnapshotPath, time.Duration(cfg.SnapshotIntervalSec)*time.Second, stop)
+    go runSweeper(time.Duration(cfg.DriverTTLSec)*time.Second,
+                    time.Duration(cfg.SweepIntervalSec)*time.Second, stop)
+
     /* Register the endpoints to be supported.
      * LoggingMiddleware is a middleware that encloses
-     * every request handler method
+     * every request handler method, and MetricsMiddleware
+     * counts them for /metrics
      */
-    routeHandler := http.HandlerFunc(route)
-    http.Handle("/", LoggingMiddleware(routeHandler))
+    app := newApp(cfg, dispatcher)
+    routeHandler := http.HandlerFunc(app.route)
+    srv := &http.Server{Addr: cfg.ListenAddr, Handler: LoggingMiddleware(MetricsMiddleware(routeHandler))}
 
-    /* should be the last line to start the http server */
-    log.Println("Starting listening on http://localhost:8080 ...")
-    http.ListenAndServe(":8080", nil)
+    /* serve in background while main waits for a signal to stop */
+    sig := make(chan os.Signal, 1)
+    signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+    go func() {
+        logInfo("Starting listening on %v ...", cfg.ListenAddr)
+        if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+            logError("Exiting: %v", err)
+            os.Exit(1)
+        }
+    }()
+
+    logInfo("Received %v, shutting down", <-sig)
+    shutdown(app, srv, stop)
 }
 
+/* Stops the application gracefully within cfg.ShutdownTimeoutSec -
+ *  0. turns /readyz down so that no new traffic is sent here, and keeps
+ *     serving for cfg.ReadyDrainSec so that probes get to see it
+ *  1. stops accepting connections and lets running requests finish
+ *  2. lets the workers apply every queued job and then stops them
+ *  3. persists the store through closeDB
+ * If deadline passes before queued jobs are applied, or the store fails to
+ * close, the write-ahead log is kept so that they are replayed on next start.
+ */
+func shutdown(app *App, srv *http.Server, stop chan bool) {
+    cfg, dispatcher := app.cfg, app.dispatcher
+    atomic.StoreInt32(&app.shuttingDown, 1)
+    time.Sleep(time.Duration(cfg.ReadyDrainSec) * time.Second)
+
+    timeout := time.Duration(cfg.ShutdownTimeoutSec) * time.Second
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
 
+    close(stop)         // periodic snapshots, sweeper and wal syncing
+    if err := srv.Shutdown(ctx); err != nil {
+        logError("Error in shutting down HTTP server - %v", err)
+    }
+
+    drained := true
+    if err := dispatcher.Stop(ctx); err != nil {
+        logError("Error in draining job queue - %v", err)
+        drained = false
+    }
+
+    checkpointMu.Lock()
+    defer checkpointMu.Unlock()
+    if wal != nil {
+        if err := wal.Close(); err != nil {
+            logError("Error in closing write-ahead log - %v", err)
+            drained = false
+        }
+    }
+    if ok := closeDB(cfg.SnapshotPath); !ok {
+        drained = false
+    }
+    if wal != nil && drained {
+        if err := wal.Discard(); err != nil {
+            logError("Error in discarding write-ahead log - %v", err)
+        }
+    }
+    logInfo("Shut down")
+}
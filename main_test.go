@@ -21,8 +21,24 @@ import (
     "testing"
     "net/http"
     "net/url"
+    "net/http/httptest"
     "io/ioutil"
     "strings"
+    "math/rand"
+    "encoding/json"
+    "fmt"
+    "sync"
+    "time"
+    "os"
+    "path/filepath"
+    "context"
+    "sync/atomic"
+    "runtime"
+    "bytes"
+    "log"
+    "errors"
+    "reflect"
+    "hash/crc32"
 )
 
 
@@ -30,7 +46,7 @@ import (
  */
 func Test_write_and_read_db(t *testing.T) {
     /* initialize DB */
-    initDB()
+    initDB(defaultConfig())
     defer closeDB("test_metadata.txt")      //dumps the Driver data from memory into this file after executing
                                             //the test; defer is GO's way of executing this func() after
                                             //current func() has exited
@@ -42,6 +58,7 @@ func Test_write_and_read_db(t *testing.T) {
                         {Id: 1234, Latitude: 10.97161923, Longitude: 75.59463452, AccOrDist: 0.9},
                      }
     for _, work := range drivers {
+        work.ReceivedAt = nowMillis()
         job := Job{Payload: work}
         if err := job.WriteToDB(); err != nil {
             t.Error("Expected nil, got ", err)
@@ -56,7 +73,7 @@ func Test_write_and_read_db(t *testing.T) {
                         {"lat":12,"lon":77,"rad":1000,"lim":1},         //0 match
                     }
     for i, c := range clients {
-        results, errStr, _ := getNearestDrivers(c)
+        results, errStr, _ := getNearestDrivers(context.Background(), c)
         if len(errStr) > 0 {
             t.Error("Expected nil, got error ", errStr)
             continue
@@ -77,64 +94,2557 @@ func Test_write_and_read_db(t *testing.T) {
 }
 
 
+/* Tests our code for reading and writing the driver data in STORE_MYSQL DB.
+ * Uses the "fakesql" stand-in defined in fakeSql_test.go in place of a live server
+ */
+func Test_write_and_read_mysql_store(t *testing.T) {
+    s := &mysqlStore{driverName: "fakesql", dsn: t.Name()}
+    if err := s.Init(); err != nil {
+        t.Fatal("Expected SQL store to initialise, got ", err)
+    }
+    defer s.Close("")
+
+    var drivers = []DriverStore{
+                        {Id: 1234, Latitude: 12.97161923, Longitude: 77.59463452, AccOrDist: 0.7},
+                        {Id: 6547, Latitude: 12.96161923, Longitude: 77.58463452, AccOrDist: 0.8},
+                        {Id: 1234, Latitude: 10.97161923, Longitude: 75.59463452, AccOrDist: 0.9},     //moves 1234 away
+                     }
+    for _, d := range drivers {
+        if err := s.Upsert(d); err != nil {
+            t.Error("Expected nil, got ", err)
+        }
+    }
+
+    var clients = []Values{
+                        {"lat":12,"lon":77,"rad":200000,"lim":4},       //2 matches
+                        {"lat":12.96,"lon":77.58,"rad":2000,"lim":4},   //1 match, 1234 has moved
+                        {"lat":12,"lon":77,"rad":1000,"lim":1},         //0 match
+                    }
+    expected := []int{2, 1, 0}
+    for i, c := range clients {
+        results, err := s.Nearest(c)
+        if err != nil {
+            t.Error("Expected nil, got error ", err)
+            continue
+        }
+        if len(results) != expected[i] {
+            t.Errorf("Expected count %v for client %v, got %v", expected[i], i, results)
+        }
+    }
+
+    if d, ok, err := s.Get(1234); err != nil || !ok || d.Latitude != 10.97161923 {
+        t.Error("Expected latest location of 1234, got ", d, ok, err)
+    }
+    if _, ok, err := s.Get(42); err != nil || ok {
+        t.Error("Expected 42 to be not found, got ", ok, err)
+    }
+}
+
+
+/* Store that records what it was asked, for checking that the rest of
+ * the code goes through the Store interface
+ */
+type fakeStore struct {
+    upserts []DriverStore
+    nearest []DriverStore
+}
+
+func (f *fakeStore) Init() error                    { return nil }
+func (f *fakeStore) Close(snapshot string) error    { return nil }
+func (f *fakeStore) Upsert(d DriverStore) error     { f.upserts = append(f.upserts, d); return nil }
+func (f *fakeStore) Get(id float64) (DriverStore, bool, error) {
+    return DriverStore{}, false, nil
+}
+func (f *fakeStore) GetState(id float64) (DriverStore, bool, error) {
+    return DriverStore{}, false, nil
+}
+func (f *fakeStore) SetVehicle(v Vehicle) error              { return nil }
+func (f *fakeStore) RemoveLocation(id float64, at int64) (bool, error) { return false, nil }
+func (f *fakeStore) CreateProfile(p DriverProfile) error     { return nil }
+func (f *fakeStore) UpdateProfile(p DriverProfile) error     { return nil }
+func (f *fakeStore) GetProfile(id float64) (DriverProfile, bool, error) {
+    return DriverProfile{Id: id, Active: true}, true, nil          // every driver is registered
+}
+func (f *fakeStore) Nearest(v Values) ([]DriverStore, error) { return f.nearest, nil }
+func (f *fakeStore) Evict(before int64) (int, error)        { return 0, nil }
+func (f *fakeStore) Count() (int, error)                    { return len(f.nearest), nil }
+func (f *fakeStore) SetStatus(id float64, s DriverStatus) (DriverStatus, error) {
+    return "", errDriverNotFound
+}
+
+
+/* Tests that jobs and GET handler use the injected store
+ */
+func Test_injected_store(t *testing.T) {
+    saved := db
+    defer func() { db = saved }()
+    fake := &fakeStore{nearest: []DriverStore{{Id: 42, Latitude: 12, Longitude: 77, AccOrDist: 10}}}
+    db = fake
+
+    job := Job{Payload: DriverStore{Id: 7, Latitude: 1, Longitude: 2, AccOrDist: 0.5}}
+    if err := job.WriteToDB(); err != nil || len(fake.upserts) != 1 || fake.upserts[0].Id != 7 {
+        t.Error("Expected upsert of driver 7 in injected store, got ", fake.upserts, err)
+    }
+
+    w := httptest.NewRecorder()
+    testApp().route(w, httptest.NewRequest("GET", "/drivers?latitude=12&longitude=77", nil))
+    if w.Code != 200 || !strings.Contains(w.Body.String(), `"id":42`) {
+        t.Error("Expected driver 42 from injected store, got ", w.Code, w.Body.String())
+    }
+}
+
+
+/* Tests that the bounding box used for narrowing SQL scans contains the search circle
+ */
+func Test_range_of_coordinates(t *testing.T) {
+    v := Values{"lat": 60, "lon": 10, "rad": 10000}
+    minLat, maxLat, minLon, maxLon := getRangeOfCoordinates(v)
+
+    /* points exactly at radius towards north and east must lie within the box */
+    if Distance(60, 10, maxLat, 10) < 10000 || Distance(60, 10, 60, maxLon) < 10000 {
+        t.Error("Expected box to cover the radius, got ", minLat, maxLat, minLon, maxLon)
+    }
+    if minLat >= 60 || minLon >= 10 {
+        t.Error("Expected box around the coordinates, got ", minLat, maxLat, minLon, maxLon)
+    }
+
+    /* near a pole the circle reaches far wider in longitude than at its centre */
+    v = Values{"lat": 80, "lon": 0, "rad": 1000000, "lim": 10}
+    if _, _, minLon, maxLon = getRangeOfCoordinates(v); minLon > -58 || maxLon < 58 {
+        t.Error("Expected box to reach 58 degrees of longitude, got ", minLon, maxLon)
+    }
+    if d := Distance(80, 0, 84, 58); d > 1000000 {
+        t.Fatal("Expected (84, 58) within 1000km, got ", d)
+    }
+    mem := &memoryStore{}
+    sqlStore := &mysqlStore{driverName: "fakesql", dsn: t.Name()}
+    for _, s := range []Store{mem, sqlStore} {
+        if err := s.Init(); err != nil {
+            t.Fatal("Expected store to initialise, got ", err)
+        }
+        defer s.Close("")
+        s.Upsert(DriverStore{Id: 1, Latitude: 84, Longitude: 58})
+        if results, _ := s.Nearest(v); len(results) != 1 {
+            t.Error("Expected driver at (84, 58) to be found, got ", results)
+        }
+    }
+
+    /* a circle taking in the pole or crossing the antimeridian spans all longitudes */
+    for _, v := range []Values{{"lat": 85, "lon": 10, "rad": 1000000}, {"lat": -1, "lon": 179.9, "rad": 50000}} {
+        if _, _, minLon, maxLon := getRangeOfCoordinates(v); minLon != -180 || maxLon != 180 {
+            t.Error("Expected whole longitude range for ", v, ", got ", minLon, maxLon)
+        }
+    }
+}
+
+
+/* Tests that stores return the "lim" nearest drivers sorted by distance,
+ * with ties on distance ordered by id, whatever the order of writes
+ */
+func Test_nearest_sorted_and_deterministic(t *testing.T) {
+    mem := &memoryStore{}
+    sqlStore := &mysqlStore{driverName: "fakesql", dsn: t.Name()}
+    for _, s := range []Store{mem, sqlStore} {
+        if err := s.Init(); err != nil {
+            t.Fatal("Expected store to initialise, got ", err)
+        }
+        defer s.Close("")
+
+        /* driver i is ~i*100m north of query point; 100+i sits at the same place as i */
+        r := rand.New(rand.NewSource(7))
+        for _, i := range r.Perm(20) {
+            lat := 12.97 + float64(i+1)*0.0009
+            s.Upsert(DriverStore{Id: float64(200 - i), Latitude: lat, Longitude: 77.59})
+            s.Upsert(DriverStore{Id: float64(100 - i), Latitude: lat, Longitude: 77.59})
+        }
+
+        results, err := s.Nearest(Values{"lat": 12.97, "lon": 77.59, "rad": 5000, "lim": 5})
+        if err != nil {
+            t.Fatal("Expected nil, got error ", err)
+        }
+        expected := []float64{100, 200, 99, 199, 98}
+        if len(results) != len(expected) {
+            t.Fatalf("Expected %v drivers, got %v", len(expected), results)
+        }
+        for i, d := range results {
+            if d.Id != expected[i] {
+                t.Errorf("Expected driver %v at position %v, got %v", expected[i], i, d.Id)
+            }
+            if i > 0 && d.AccOrDist < results[i-1].AccOrDist {
+                t.Error("Expected ascending distances, got ", results)
+            }
+        }
+    }
+}
+
+
+/* Tests that snapshots are read back as written and that damaged ones are rejected
+ */
+func Test_snapshot_round_trip(t *testing.T) {
+    dir, err := ioutil.TempDir("", "snapshot")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "drivers.snapshot")
+
+    m := &memoryStore{}
+    m.Init()
+    m.Upsert(DriverStore{Id: 12, Latitude: 12.97161923, Longitude: 77.59463452, AccOrDist: 0.7})
+    m.Upsert(DriverStore{Id: 13, Latitude: 11.97161923, Longitude: 76.59463452, AccOrDist: 0.8})
+    m.SetVehicle(Vehicle{Id: 12, Class: VEHICLE_SEDAN, Seats: 4})
+    m.SetVehicle(Vehicle{Id: 99, Class: VEHICLE_BIKE, Seats: 1})        //not located yet
+    m.CreateProfile(DriverProfile{Id: 12, Name: "Ravi", Active: true, CreatedAt: 1, UpdatedAt: 2})
+    if err := m.Close(path); err != nil {
+        t.Fatal("Expected nil, got ", err)
+    }
+
+    restored := &memoryStore{}
+    restored.Init()
+    data, err := readSnapshot(path)
+    if err != nil || len(data.drivers) != 2 || len(data.vehicles) != 2 || len(data.profiles) != 1 {
+        t.Fatal("Expected 2 drivers and vehicles and a profile from snapshot, got ", data, err)
+    }
+    restored.Restore(data)
+    if d, ok, _ := restored.Get(12); !ok || d.Latitude != 12.97161923 || d.AccOrDist != 0.7 ||
+            d.Vehicle == nil || d.Vehicle.Class != VEHICLE_SEDAN {
+        t.Error("Expected driver 12 to be restored with vehicle, got ", d, ok)
+    }
+    if p, ok, _ := restored.GetProfile(12); !ok || p.Name != "Ravi" || !p.Active || p.UpdatedAt != 2 {
+        t.Error("Expected profile of driver 12 to be restored, got ", p, ok)
+    }
+    restored.Upsert(DriverStore{Id: 99, Latitude: 12.9, Longitude: 77.5})
+    if d, _, _ := restored.Get(99); d.Vehicle == nil || d.Vehicle.Class != VEHICLE_BIKE {
+        t.Error("Expected vehicle of driver 99 to be restored, got ", d.Vehicle)
+    }
+
+
+    /* snapshots written before vehicles are still read */
+    v1 := []byte(snapshotHeaderV1 + "\n" + `{"id":5,"latitude":1,"longitude":2}` + "\n")
+    v1 = append(v1, fmt.Sprintf("END 1 %08x\n", crc32.ChecksumIEEE(v1[len(snapshotHeaderV1)+1:]))...)
+    v1Path := filepath.Join(dir, "v1.snapshot")
+    ioutil.WriteFile(v1Path, v1, 0600)
+    if data, err := readSnapshot(v1Path); err != nil || len(data.drivers) != 1 || data.drivers[0].Id != 5 {
+        t.Error("Expected driver from version 1 snapshot, got ", data, err)
+    }
+
+    /* truncated and corrupted copies must be rejected */
+    b, _ := ioutil.ReadFile(path)
+    damaged := map[string][]byte{
+                    "truncated": b[:len(b)-20],
+                    "corrupted": []byte(strings.Replace(string(b), "12.97", "12.98", 1)),
+                    "empty":     []byte{},
+                }
+    for name, content := range damaged {
+        ioutil.WriteFile(path, content, 0600)
+        if _, err := readSnapshot(path); err != errCorruptSnapshot {
+            t.Errorf("Expected %v snapshot to be rejected, got %v", name, err)
+        }
+    }
+
+    /* missing snapshot means nothing to load */
+    saved := db
+    defer func() { db = saved }()
+    db = restored
+    if err := loadSnapshot(filepath.Join(dir, "missing")); err != nil {
+        t.Error("Expected nil for missing snapshot, got ", err)
+    }
+    if err := loadSnapshot(path); err == nil {
+        t.Error("Expected error loading corrupt snapshot")
+    }
+}
+
+
+/* Tests that updates in write-ahead log are replayed after a crash, that a
+ * torn last record is skipped and that compaction waits for pending updates
+ */
+func Test_wal_replay_and_compact(t *testing.T) {
+    dir, err := ioutil.TempDir("", "wal")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    snap := filepath.Join(dir, "drivers.snapshot")
+
+    saved := db
+    defer func() { db = saved }()
+    db = &memoryStore{}
+    db.Init()
+
+    l, err := openWAL(dir, snap)
+    if err != nil {
+        t.Fatal("Expected nil, got ", err)
+    }
+    l.Append("", DriverStore{Id: 1, Latitude: 12.1, Longitude: 77.1})
+    l.Append("", DriverStore{Id: 2, Latitude: 12.2, Longitude: 77.2})
+    l.Append("", DriverStore{Id: 1, Latitude: 12.3, Longitude: 77.3})
+    l.Sync()
+
+    /* crash before workers applied anything, in the middle of writing a record */
+    l.cur.file.WriteString(`1234abcd {"id":3,"lati`)
+    l.cur.file.Close()
+
+    db = &memoryStore{}
+    db.Init()
+    if l, err = openWAL(dir, snap); err != nil {
+        t.Fatal("Expected nil, got ", err)
+    }
+    if d, ok, _ := db.Get(1); !ok || d.Latitude != 12.3 {
+        t.Error("Expected latest update of driver 1 to be replayed, got ", d, ok)
+    }
+    if _, ok, _ := db.Get(3); ok {
+        t.Error("Expected torn record of driver 3 to be skipped")
+    }
+    if data, err := readSnapshot(snap); err != nil || len(data.drivers) != 2 {
+        t.Error("Expected replayed updates in snapshot, got ", data, err)
+    }
+
+    /* compaction must not go ahead of a worker still applying an update */
+    seg, _ := l.Append("", DriverStore{Id: 4, Latitude: 12.4, Longitude: 77.4})
+    go func() {
+        time.Sleep(50 * time.Millisecond)
+        db.Upsert(DriverStore{Id: 4, Latitude: 12.4, Longitude: 77.4})
+        seg.pending.Done()
+    }()
+    if err := l.Compact(snap); err != nil {
+        t.Fatal("Expected nil, got ", err)
+    }
+    if data, err := readSnapshot(snap); err != nil || len(data.drivers) != 3 {
+        t.Error("Expected pending update in snapshot, got ", data, err)
+    }
+    if seqs, _ := walSegments(dir); len(seqs) != 1 || seqs[0] != l.cur.seq {
+        t.Error("Expected only the current segment to be left, got ", seqs)
+    }
+    l.Close()
+}
+
+
+/* Tests that Appends go on while the log is being fsync'ed, and that syncing
+ * and compacting alongside Appends lose no record
+ */
+func Test_wal_sync_does_not_block_append(t *testing.T) {
+    dir, err := ioutil.TempDir("", "wal")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    snap := filepath.Join(dir, "drivers.snapshot")
+
+    saved := db
+    defer func() { db = saved }()
+    db = &memoryStore{}
+    db.Init()
+
+    l, err := openWAL(dir, snap)
+    if err != nil {
+        t.Fatal("Expected nil, got ", err)
+    }
+
+    /* an fsync in progress holds syncMu */
+    l.syncMu.Lock()
+    done := make(chan bool)
+    go func() {
+        if seg, err := l.Append("", DriverStore{Id: 1, Latitude: 12.1, Longitude: 77.1}); err == nil {
+            seg.pending.Done()
+        }
+        done <- true
+    }()
+    select {
+        case <-done:
+            l.syncMu.Unlock()
+        case <-time.After(time.Second):
+            t.Error("Expected Append not to wait for fsync")
+            l.syncMu.Unlock()
+            <-done
+    }
+
+    var wg sync.WaitGroup
+    for g := 0; g < 4; g++ {
+        wg.Add(1)
+        go func(g int) {
+            defer wg.Done()
+            for i := 0; i < 200; i++ {
+                seg, err := l.Append("", DriverStore{Id: float64(g*1000 + i + 2), Latitude: 12, Longitude: 77})
+                if err != nil {
+                    t.Error("Expected nil, got ", err)
+                    return
+                }
+                seg.pending.Done()
+                if i % 50 == 0 {
+                    l.Sync()
+                }
+            }
+        }(g)
+    }
+    if err := l.Compact(snap); err != nil {
+        t.Error("Expected nil, got ", err)
+    }
+    wg.Wait()
+    if err := l.Close(); err != nil {
+        t.Fatal("Expected nil, got ", err)
+    }
+
+    /* records appended after compaction are left in the current segment, intact */
+    n := 0
+    seqs, _ := walSegments(dir)
+    for _, seq := range seqs {
+        if _, err := replayWALSegment(walSegmentPath(dir, seq), func(string, []byte) error { n++; return nil }); err != nil {
+            t.Error("Expected intact segment, got ", err)
+        }
+    }
+    if len(seqs) != 1 || n > 800 {
+        t.Error("Expected current segment with at most 800 records, got ", seqs, n)
+    }
+}
+
+/* Tests that changes other than location updates - profiles, vehicles,
+ * status and removal of locations - are replayed from write-ahead log too
+ */
+func Test_wal_replays_registry_changes(t *testing.T) {
+    dir, err := ioutil.TempDir("", "wal")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    snap := filepath.Join(dir, "drivers.snapshot")
+
+    savedWal := wal
+    defer func() { wal = savedWal }()
+    _, send := newTestApp(t, &memoryStore{})
+    if wal, err = openWAL(dir, snap); err != nil {
+        t.Fatal("Expected nil, got ", err)
+    }
+
+    send("POST", "/drivers/1/profile", `{"name": "Asha"}`)
+    send("POST", "/drivers/2/profile", `{"name": "Ravi"}`)
+    now := nowMillis()
+    for _, id := range []float64{1, 2} {
+        d := DriverStore{Id: id, Latitude: 12.97, Longitude: 77.59, ReceivedAt: now, Timestamp: now}
+        seg, _ := wal.Append("", d)
+        db.Upsert(d)
+        seg.pending.Done()
+    }
+    changes := []struct{ method, path, body string; code int }{
+                    {"PUT", "/drivers/1/profile", `{"name": "Asha K"}`, 200},
+                    {"PUT", "/drivers/1/vehicle", `{"class": "xl", "seats": 6}`, 200},
+                    {"PUT", "/drivers/1/status", `{"status": "on_trip"}`, 200},
+                    {"DELETE", "/drivers/2/location", ``, 204},
+                }
+    for _, c := range changes {
+        if w := send(c.method, c.path, c.body); w.Code != c.code {
+            t.Fatal("Expected ", c.code, " for ", c.method, " ", c.path, ", got ", w.Code, w.Body.String())
+        }
+    }
+
+    /* crash before any snapshot */
+    wal.Sync()
+    wal.cur.file.Close()
+
+    db = &memoryStore{}
+    db.Init()
+    if wal, err = openWAL(dir, snap); err != nil {
+        t.Fatal("Expected nil, got ", err)
+    }
+    defer wal.Close()
+    if p, ok, _ := db.GetProfile(1); !ok || p.Name != "Asha K" {
+        t.Error("Expected updated profile of driver 1, got ", p, ok)
+    }
+    if p, ok, _ := db.GetProfile(2); !ok || p.Name != "Ravi" {
+        t.Error("Expected profile of driver 2, got ", p, ok)
+    }
+    d, ok, _ := db.Get(1)
+    if !ok || d.Status != STATUS_ON_TRIP || d.Vehicle == nil || d.Vehicle.Class != VEHICLE_XL {
+        t.Error("Expected status and vehicle of driver 1, got ", d, ok)
+    }
+    if d, ok, _ := db.Get(2); ok {
+        t.Error("Expected location of driver 2 to stay removed, got ", d)
+    }
+}
+
+/* Tests that drivers not updated within TTL are left out of searches and evicted
+ */
+func Test_stale_drivers_expire(t *testing.T) {
+    mem := &memoryStore{}
+    sqlStore := &mysqlStore{driverName: "fakesql", dsn: t.Name()}
+    now := nowMillis()
+    ttl := int64(defaultConfig().DriverTTLSec)
+    for _, s := range []Store{mem, sqlStore} {
+        if err := s.Init(); err != nil {
+            t.Fatal("Expected store to initialise, got ", err)
+        }
+        defer s.Close("")
+
+        s.Upsert(DriverStore{Id: 1, Latitude: 12.97, Longitude: 77.59, ReceivedAt: now})
+        s.Upsert(DriverStore{Id: 2, Latitude: 12.97, Longitude: 77.59, ReceivedAt: now - (ttl+1)*1000})
+
+        v := Values{"lat": 12.97, "lon": 77.59, "rad": 500, "lim": 10, "since": float64(now - ttl*1000)}
+        if results, _ := s.Nearest(v); len(results) != 1 || results[0].Id != 1 {
+            t.Error("Expected only fresh driver 1 in search, got ", results)
+        }
+        if n, err := s.Evict(now - ttl*1000); n != 1 || err != nil {
+            t.Error("Expected 1 driver evicted, got ", n, err)
+        }
+        if _, ok, _ := s.Get(2); ok {
+            t.Error("Expected stale driver 2 to be evicted")
+        }
+    }
+
+    /* age of location is reported in response */
+    saved := db
+    defer func() { db = saved }()
+    db = &fakeStore{nearest: []DriverStore{{Id: 1, ReceivedAt: now - 42000}}}
+    w := httptest.NewRecorder()
+    testApp().route(w, httptest.NewRequest("GET", "/drivers?latitude=12&longitude=77", nil))
+    if !strings.Contains(w.Body.String(), `"age":42`) {
+        t.Error("Expected age of 42 sec in response, got ", w.Body.String())
+    }
+}
+
+
+/* Tests that the grid index follows drivers moving across cells
+ */
+func Test_grid_index_moves(t *testing.T) {
+    m := &memoryStore{}
+    m.Init()
+    m.Upsert(DriverStore{Id: 1, Latitude: 12.97, Longitude: 77.59})
+    m.Upsert(DriverStore{Id: 1, Latitude: 28.61, Longitude: 77.20})     //moves to another city
+
+    near := Values{"lat": 12.97, "lon": 77.59, "rad": 1000, "lim": 10}
+    if results, _ := m.Nearest(near); len(results) != 0 {
+        t.Error("Expected driver to be gone from old cell, got ", results)
+    }
+    near = Values{"lat": 28.61, "lon": 77.20, "rad": 1000, "lim": 10}
+    if results, _ := m.Nearest(near); len(results) != 1 {
+        t.Error("Expected driver in new cell, got ", results)
+    }
+    if cells := m.shardOf(1).grid.cells; len(cells) != 1 {
+        t.Error("Expected empty cells to be dropped, got ", len(cells))
+    }
+}
+
+
+/* Tests that the grid finds the same drivers as a full scan for searches at
+ * high latitudes, where the circle is widest in longitude, and across the
+ * antimeridian
+ */
+func Test_grid_matches_full_scan(t *testing.T) {
+    m := &memoryStore{}
+    m.Init()
+    r := rand.New(rand.NewSource(1))
+    for i := 1; i <= 3000; i++ {
+        lat := 60 + r.Float64()*30
+        if i % 2 == 0 {
+            lat = -lat
+        }
+        m.Upsert(DriverStore{Id: float64(i), Latitude: lat, Longitude: r.Float64()*360 - 180})
+    }
+    for q := 0; q < 300; q++ {
+        lat := 65 + r.Float64()*24.9
+        if q % 2 == 0 {
+            lat = -lat
+        }
+        v := Values{"lat": lat, "lon": r.Float64()*360 - 180, "rad": 10000 + r.Float64()*1500000, "lim": 3000}
+        grid, _ := m.Nearest(v)
+        if scan := scanNearest(m, v); !reflect.DeepEqual(grid, scan) {
+            t.Fatal("Expected ", len(scan), " drivers of full scan for ", v, ", got ", len(grid))
+        }
+    }
+}
+
+
+/* Fills a memory store with drivers spread over ~50km around Bangalore
+ */
+func benchStore(n int) *memoryStore {
+    m := &memoryStore{}
+    m.Init()
+    r := rand.New(rand.NewSource(1))
+    for i := 1; i <= n; i++ {
+        m.Upsert(DriverStore{Id: float64(i), Latitude: 12.75 + r.Float64()*0.5,
+                                Longitude: 77.35 + r.Float64()*0.5, AccOrDist: 0.7})
+    }
+    return m
+}
+
+/* Full scan of every driver, as done before the grid index, kept for comparison
+ */
+func scanNearest(m *memoryStore, v Values) []DriverStore {
+    c := newNearestCollector(int(v["lim"]))
+    for _, sh := range m.shards {
+        for _, d := range sh.drivers {
+            if dis := Distance(v["lat"], v["lon"], d.Latitude, d.Longitude); dis <= v["rad"] {
+                d.AccOrDist = dis
+                c.offer(d)
+            }
+        }
+    }
+    return c.sorted()
+}
+
+/* Benchmarks for searching 50,000 drivers with grid index against full scan.
+ * Run with - $ go test -bench Nearest
+ */
+var benchCfg = defaultConfig()
+var benchQuery = Values{"lat": 12.97, "lon": 77.59, "rad": benchCfg.Radius, "lim": float64(benchCfg.Limit)}
+
+func BenchmarkNearestGrid(b *testing.B) {
+    m := benchStore(benchCfg.MaxDriverId)
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        m.Nearest(benchQuery)
+    }
+}
+
+func BenchmarkNearestFullScan(b *testing.B) {
+    m := benchStore(benchCfg.MaxDriverId)
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        scanNearest(m, benchQuery)
+    }
+}
+
+
+/* Tests that GET /drivers responds with a JSON array of DriverResp
+ */
+func Test_get_drivers_json(t *testing.T) {
+    saved := db
+    defer func() { db = saved }()
+    fake := &fakeStore{}
+    db = fake
+
+    w := httptest.NewRecorder()
+    testApp().route(w, httptest.NewRequest("GET", "/drivers?latitude=12&longitude=77", nil))
+    if w.Code != 200 || strings.TrimSpace(w.Body.String()) != "[]" {
+        t.Error("Expected empty JSON array, got ", w.Code, w.Body.String())
+    }
+    if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+        t.Error("Expected application/json, got ", ct)
+    }
+
+    now := nowMillis()
+    fake.nearest = []DriverStore{{Id: 42, Latitude: 12.5, Longitude: 77.5, AccOrDist: 123.6, ReceivedAt: now},
+                                 {Id: 84, Latitude: 12.6, Longitude: 77.6, AccOrDist: 200.2, ReceivedAt: now}}
+    w = httptest.NewRecorder()
+    testApp().route(w, httptest.NewRequest("GET", "/drivers?latitude=12&longitude=77", nil))
+    var resp []DriverResp
+    if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+        t.Fatal("Expected valid JSON, got ", err, w.Body.String())
+    }
+    expected := []DriverResp{{Id: 42, Latitude: 12.5, Longitude: 77.5, Distance: 124},
+                             {Id: 84, Latitude: 12.6, Longitude: 77.6, Distance: 200}}
+    if len(resp) != 2 || resp[0] != expected[0] || resp[1] != expected[1] {
+        t.Error("Expected ", expected, ", got ", resp)
+    }
+}
+
+
+/* Tests that /metrics reports requests by route and status along with
+ * dispatcher and store figures in Prometheus text format
+ */
+func Test_metrics_endpoint(t *testing.T) {
+    saved := db
+    defer func() { db = saved }()
+    db = &fakeStore{nearest: []DriverStore{{Id: 1, ReceivedAt: nowMillis()}, {Id: 2, ReceivedAt: nowMillis()}}}
+
+    app := testApp()
+    handler := MetricsMiddleware(http.HandlerFunc(app.route))
+    requests := []*http.Request{
+                    httptest.NewRequest("GET", "/drivers?latitude=12&longitude=77", nil),
+                    httptest.NewRequest("GET", "/drivers?latitude=120&longitude=77", nil),
+                    httptest.NewRequest("PUT", "/drivers/12/location", strings.NewReader(`{"latitude": 100}`)),
+                    httptest.NewRequest("GET", "/nowhere", nil),
+                }
+    for _, r := range requests {
+        handler.ServeHTTP(httptest.NewRecorder(), r)
+    }
+
+    w := httptest.NewRecorder()
+    handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+    if w.Code != 200 || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+        t.Fatal("Expected metrics in text, got ", w.Code, w.Header().Get("Content-Type"))
+    }
+    body := w.Body.String()
+    expected := []string{
+                    "# TYPE uber_http_requests_total counter\n",
+                    `uber_http_requests_total{route="/drivers",method="GET",code="200"} `,
+                    `uber_http_requests_total{route="/drivers",method="GET",code="400"} `,
+                    `uber_http_requests_total{route="/drivers/{id}/location",method="PUT",code="422"} `,
+                    `uber_http_requests_total{route="unknown",method="GET",code="404"} `,
+                    "# TYPE uber_http_request_duration_seconds histogram\n",
+                    `uber_http_request_duration_seconds_bucket{route="/drivers",method="GET",code="200",le="0.1"} `,
+                    `uber_http_request_duration_seconds_bucket{route="/drivers",method="GET",code="200",le="+Inf"} `,
+                    `uber_http_request_duration_seconds_count{route="/drivers",method="GET",code="200"} `,
+                    "\nuber_jobs_pending ",
+                    "\nuber_job_queue_depth ",
+                    `uber_workers{state="busy"} `,
+                    `uber_workers{state="idle"} `,
+                    "\nuber_coalesced_updates_total ",
+                    "\nuber_db_write_errors_total ",
+                    "\nuber_nearest_searches_total ",
+                    "\nuber_nearest_scanned_drivers_total ",
+                    "\nuber_store_drivers 2\n",
+                }
+    for _, e := range expected {
+        if !strings.Contains(body, e) {
+            t.Errorf("Expected %q in metrics, got\n%v", e, body)
+        }
+    }
+}
+
+
+/* Tests that LoggingMiddleware logs status, bytes and latency of requests,
+ * as JSON lines or text, at levels set by config
+ */
+func Test_logging_middleware(t *testing.T) {
+    var buf syncBuffer
+    savedOut, savedConfig := logger.Writer(), logConfig
+    defer func() {
+        logger.SetOutput(savedOut)
+        logConfig = savedConfig
+        logger.SetFlags(log.LstdFlags)
+    }()
+    logger.SetOutput(&buf)
+
+    handler := LoggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/slow" {
+            time.Sleep(20 * time.Millisecond)
+        }
+        if r.URL.Path == "/missing" {
+            w.WriteHeader(404)
+        }
+        w.Write([]byte("hello"))
+    }))
+    serve := func(path string) string {
+        w := httptest.NewRecorder()
+        handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+        return w.Header().Get("X-Request-ID")
+    }
+
+    /* workers of other tests may log alongside, so lines are picked by request id */
+    linesOf := func(id string) []string {
+        var lines []string
+        for _, line := range strings.Split(buf.String(), "\n") {
+            if strings.Contains(line, id) {
+                lines = append(lines, line)
+            }
+        }
+        return lines
+    }
+
+    cfg := defaultConfig()
+    cfg.LogFormat = "json"
+    cfg.SlowRequestMs = 10
+    setupLogging(cfg)
+    expected := []struct {
+        path    string
+        level   string
+        status  float64
+    }{{"/fast", "info", 200}, {"/missing", "warn", 404}, {"/slow", "warn", 200}}
+    for _, e := range expected {
+        id := serve(e.path)
+        if len(id) != 16 {
+            t.Fatal("Expected generated request id, got ", id)
+        }
+        lines := linesOf(id)
+        if len(lines) != 1 {
+            t.Fatal("Expected one line per request at info level, got ", lines)
+        }
+        var entry map[string]interface{}
+        if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+            t.Fatal("Expected JSON line, got ", lines[0])
+        }
+        if entry["level"] != e.level || entry["status"] != e.status || entry["bytes"] != 5.0 ||
+                entry["request_id"] != id {
+            t.Error("Expected ", e, " with 5 bytes, got ", lines[0])
+        }
+        if us := entry["latency_us"].(float64); e.path == "/slow" && (us < 20000 || us > 2000000) {
+            t.Error("Expected latency in microseconds, got ", us)
+        }
+    }
+
+    cfg.LogFormat = "text"
+    cfg.LogLevel = "debug"
+    setupLogging(cfg)
+    out := strings.Join(linesOf(serve("/missing")), "\n")
+    if !strings.Contains(out, "DEBUG Received") || !strings.Contains(out, "WARN  Responded") ||
+            !strings.Contains(out, " status=404") || !strings.Contains(out, " bytes=5") {
+        t.Error("Expected received and responded lines in text, got ", out)
+    }
+}
+
+
+/* Store failing every update
+ */
+type failingStore struct {
+    fakeStore
+}
+
+func (f *failingStore) Upsert(d DriverStore) error { return errors.New("disk full") }
+
+/* Tests that request id given by client, or generated otherwise, is echoed
+ * back and tags the log of a failure in async update of that request
+ */
+func Test_request_id_propagation(t *testing.T) {
+    var buf syncBuffer
+    savedOut, savedConfig := logger.Writer(), logConfig
+    defer func() {
+        logger.SetOutput(savedOut)
+        logConfig = savedConfig
+        logger.SetFlags(log.LstdFlags)
+    }()
+    logger.SetOutput(&buf)
+    app, _ := newTestApp(t, &failingStore{})
+    app.cfg.LogFormat = "json"
+    app.cfg.LogLevel = "error"
+    setupLogging(app.cfg)
+    handler := LoggingMiddleware(http.HandlerFunc(app.route))
+
+    body := `{"latitude": 12.97, "longitude": 77.59, "accuracy": 0.7}`
+    r := httptest.NewRequest("PUT", "/drivers/12/location", strings.NewReader(body))
+    r.Header.Set("X-Request-ID", "trip-42.retry:1")
+    w := httptest.NewRecorder()
+    handler.ServeHTTP(w, r)
+    if id := w.Header().Get("X-Request-ID"); w.Code != 200 || id != "trip-42.retry:1" {
+        t.Error("Expected client's request id echoed, got ", w.Code, id)
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    if err := app.dispatcher.Stop(ctx); err != nil {
+        t.Fatal("Expected queue to be drained, got ", err)
+    }
+    var entry map[string]interface{}
+    if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+        t.Fatal("Expected one JSON line for failed update, got ", buf.String())
+    }
+    if entry["request_id"] != "trip-42.retry:1" || !strings.Contains(entry["msg"].(string), "disk full") {
+        t.Error("Expected failure logged with request id, got ", buf.String())
+    }
+
+    /* ids unfit for logs are replaced */
+    r = httptest.NewRequest("GET", "/drivers?latitude=12&longitude=77", nil)
+    r.Header.Set("X-Request-ID", "evil\" injected=1")
+    w = httptest.NewRecorder()
+    handler.ServeHTTP(w, r)
+    if id := w.Header().Get("X-Request-ID"); len(id) != 16 || strings.Contains(id, "evil") {
+        t.Error("Expected generated request id, got ", id)
+    }
+}
+
+/* bytes.Buffer that can be written by workers while the test reads it */
+type syncBuffer struct {
+    mu  sync.Mutex
+    buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return append([]byte(nil), b.buf.Bytes()...)
+}
+
+func (b *syncBuffer) String() string { return string(b.Bytes()) }
+
+
+/* Tests the probes - liveness, readiness as queue fills up and during
+ * shutdown, and status details
+ */
+func Test_health_endpoints(t *testing.T) {
+    saved := db
+    defer func() { db = saved }()
+    store := &stalledStore{release: make(chan bool)}
+    store.nearest = []DriverStore{{Id: 1}, {Id: 2}}
+    db = store
+
+    cfg := defaultConfig()
+    cfg.MaxQueue = 10
+    cfg.ReadyQueueFillPct = 50
+    d := NewDispatcher(cfg)
+    app := newApp(cfg, d)
+    get := func(path string) *httptest.ResponseRecorder {
+        w := httptest.NewRecorder()
+        app.route(w, httptest.NewRequest("GET", path, nil))
+        return w
+    }
+
+    if w := get("/healthz"); w.Code != 200 {
+        t.Error("Expected alive, got ", w.Code)
+    }
+    if w := get("/readyz"); w.Code != 503 || !strings.Contains(w.Body.String(), "Dispatcher not running") {
+        t.Error("Expected not ready before dispatcher runs, got ", w.Code, w.Body.String())
+    }
+    d.Run()
+    if w := get("/readyz"); w.Code != 200 {
+        t.Error("Expected ready, got ", w.Code, w.Body.String())
+    }
+
+    for i := 1; i <= 5; i++ {
+        d.Submit(Job{Payload: DriverStore{Id: float64(i)}})
+    }
+    if w := get("/readyz"); w.Code != 503 || !strings.Contains(w.Body.String(), "Job queue too full") {
+        t.Error("Expected not ready with half full queue, got ", w.Code, w.Body.String())
+    }
+
+    var status StatusResp
+    w := get("/status")
+    if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+        t.Fatal("Expected status in JSON, got ", w.Body.String())
+    }
+    if status.Ready || status.Store != "memory" || status.Drivers != 2 || status.Workers != cfg.MaxWorkers ||
+            status.PendingJobs != 5 || status.QueueCapacity != 10 || status.UptimeSec < 0 {
+        t.Error("Expected status of stalled dispatcher, got ", w.Body.String())
+    }
+
+    close(store.release)
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    d.Stop(ctx)
+    atomic.StoreInt32(&app.shuttingDown, 1)
+    if w := get("/readyz"); w.Code != 503 || !strings.Contains(w.Body.String(), "Shutting down") {
+        t.Error("Expected not ready during shutdown, got ", w.Code, w.Body.String())
+    }
+    if w := get("/healthz"); w.Code != 200 {
+        t.Error("Expected still alive during shutdown, got ", w.Code)
+    }
+}
+
+
+/* Tests that /readyz fails for ready_drain_sec on shutdown while the
+ * server still answers, before connections are closed
+ */
+func Test_shutdown_drains_readiness(t *testing.T) {
+    dir, err := ioutil.TempDir("", "shutdown")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    savedDb, savedWal := db, wal
+    defer func() { db, wal = savedDb, savedWal }()
+    db, wal = &memoryStore{}, nil
+    db.Init()
+
+    cfg := defaultConfig()
+    cfg.ReadyDrainSec = 1
+    cfg.SnapshotPath = filepath.Join(dir, "drivers.snapshot")
+    d := NewDispatcher(cfg)
+    d.Run()
+    app := newApp(cfg, d)
+    ts := httptest.NewServer(http.HandlerFunc(app.route))
+    defer ts.Close()
+
+    done := make(chan bool)
+    go func() {
+        shutdown(app, ts.Config, make(chan bool))
+        close(done)
+    }()
+    deadline := time.Now().Add(500 * time.Millisecond)
+    for {
+        resp, err := http.Get(ts.URL + "/readyz")
+        if err != nil {
+            t.Fatal("Expected server to answer while draining, got ", err)
+        }
+        resp.Body.Close()
+        if resp.StatusCode == 503 {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatal("Expected /readyz to fail on shutdown, got ", resp.StatusCode)
+        }
+    }
+    select {
+        case <-done:
+            t.Fatal("Expected shutdown to wait for ready_drain_sec")
+        default:
+    }
+    <-done
+    if _, err := http.Get(ts.URL + "/readyz"); err == nil {
+        t.Error("Expected connections refused after shutdown")
+    }
+}
+
+
 /* Tests the validation function for GET requests
  */
-func Test_validate_get_request(t *testing.T) {
-    var r http.Request
-    var u url.URL
-    r.Method = "GET"
-    r.URL = &u
+func Test_validate_get_request(t *testing.T) {
+    var r http.Request
+    var u url.URL
+    r.Method = "GET"
+    r.URL = &u
+
+    queries := []string {
+                    "latitude=12&longitude=77&radius=200000&limit=2",       //valid
+                    "latitude=220&longitude=77&radius=200000&limit=2",      //invalid
+                    "latitude=12&longitude=-777&radius=200000&limit=2",     //invalid
+                    "latitude=12&longitude=77&radius=-200&limit=2",         //invalid
+                    "latitude=12&longitude=77&radius=18000000&limit=2",     //invalid
+                    "latitude=12&longitude=77&radius=200000&limit=51000",   //invalid
+                    "latitude=12&longitude=77&status=parked",               //invalid
+                }
+
+    for i, q := range queries {
+        r.URL.RawQuery = q 
+        _, errStr, _ := validateGetDriverParams(&r, defaultConfig())
+        if i==0 && len(errStr) > 0 {
+            t.Error("Expected nil for GetRequest, got error - ", errStr)
+        } 
+        if i > 0 && len(errStr) == 0 {
+            t.Error("Expected error for GetRequest number -  ", i)
+        }
+    }
+}
+
+
+/* Tests the validation function for PUT requests
+ */
+func Test_validate_put_request(t *testing.T) {
+
+    var r http.Request
+    var u url.URL
+    r.Method = "PUT"
+    r.URL = &u
+    r.URL.Path = "/drivers/123/location"
+
+    putData := []string {
+                    `{ "latitude": 12.97161923, "longitude":  77.59463452, "accuracy": 0.7 }`,     //valid                   
+                    `{ "latitude":212.97161923, "longitude":  77.59463452, "accuracy": 0.7 }`,     //invalid
+                    `{ "latitude": 12.97161923, "longitude":-777.59463452, "accuracy": 0.7 }`,     //invalid
+                    `{ "latitude": 12.97161923, "longitude":  77.59463452, "accuracy": 1.7 }`,     //invalid
+                    `{ "latitude": 12.97161923, "longitude":  77.59463452, "status": "parked" }`,  //invalid
+                }
+
+    for i, d := range putData {
+        r.Body = ioutil.NopCloser(strings.NewReader(d))
+
+        _, errStr, _ := validatePutDriverParams(&r, defaultConfig())
+        if i==0 && len(errStr) > 0 {
+            t.Error("Expected nil for PutRequest, got error - ", errStr)
+        } 
+        if i > 0 && len(errStr) == 0 {
+            t.Error("Expected error for PutRequest number -  ", i)
+        }
+    }
+}
+
+
+/* Tests that config is taken from defaults, file, env vars and flags in
+ * that order of precedence and is validated
+ */
+func Test_load_config(t *testing.T) {
+    file := filepath.Join(t.TempDir(), "uber.json")
+    ioutil.WriteFile(file, []byte(`{"listen_addr": ":9090", "max_workers": 8, "radius": 800, "limit": 5}`), 0600)
+    env := map[string]string{"UBER_CONFIG": file, "UBER_MAX_WORKERS": "6", "UBER_RADIUS": "900"}
+    getenv := func(k string) string { return env[k] }
+
+    cfg, err := loadConfig([]string{"-radius", "1000"}, getenv)
+    if err != nil {
+        t.Fatal("Expected config to load, got ", err)
+    }
+    if cfg.ListenAddr != ":9090" || cfg.Limit != 5 {
+        t.Error("Expected values from file, got ", cfg.ListenAddr, cfg.Limit)
+    }
+    if cfg.MaxWorkers != 6 {
+        t.Error("Expected env var over file, got ", cfg.MaxWorkers)
+    }
+    if cfg.Radius != 1000 {
+        t.Error("Expected flag over env var, got ", cfg.Radius)
+    }
+    if cfg.MaxDriverId != defaultConfig().MaxDriverId {
+        t.Error("Expected default for unset value, got ", cfg.MaxDriverId)
+    }
+
+    bad := [][]string {
+                []string{"-max-workers", "0"},          //fails validation
+                []string{"-store", "redis"},            //not registered
+                []string{"-driver-id-mode", "any"},     //not a mode
+                []string{"-radius", "far"},             //not a number
+                []string{"-snapshot-path", ""},         //memory store and write-ahead log need it
+                []string{"-ready-drain-sec", "-1"},
+                []string{"-store", "mysql", "-snapshot-path", ""},
+                []string{"-no-such-flag", "1"},
+            }
+    for _, args := range bad {
+        if _, err := loadConfig(args, getenv); err == nil {
+            t.Error("Expected error for ", args)
+        }
+    }
+    if _, err := loadConfig([]string{"-store", "mysql", "-snapshot-path", "", "-wal-dir", ""}, getenv); err != nil {
+        t.Error("Expected no snapshot needed for mysql without write-ahead log, got ", err)
+    }
+    env["UBER_LIMIT"] = "many"
+    if _, err := loadConfig(nil, getenv); err == nil {
+        t.Error("Expected error for bad env var")
+    }
+    delete(env, "UBER_LIMIT")
+    ioutil.WriteFile(file, []byte(`{"max_wrokers": 8}`), 0600)
+    if _, err := loadConfig(nil, getenv); err == nil {
+        t.Error("Expected error for unknown key in config file")
+    }
+}
+
+
+/* Dispatcher and workers are started once and shared by all tests
+ * sending requests through the handlers
+ */
+var dispatcherOnce sync.Once
+var testDispatcher *Dispatcher
+
+func startTestDispatcher() *Dispatcher {
+    dispatcherOnce.Do(func() {
+        testDispatcher = NewDispatcher(defaultConfig())
+        testDispatcher.Run()
+    })
+    return testDispatcher
+}
+
+/* App with default config, as main would build it
+ */
+func testApp() *App {
+    return newApp(defaultConfig(), startTestDispatcher())
+}
+
+/* Puts store, once initialised, in use and builds an App with default config
+ * over a dispatcher of its own. Returned func sends a request through the
+ * router. When the test ends, the dispatcher is stopped after applying the
+ * queued jobs, unless the test stopped it, and the store in use before is put
+ * back. Config read while serving can be changed through App.cfg
+ */
+func newTestApp(t *testing.T, store Store) (*App, func(method, path, body string) *httptest.ResponseRecorder) {
+    if err := store.Init(); err != nil {
+        t.Fatal("Expected store to initialise, got ", err)
+    }
+    saved := db
+    db = store
+    cfg := defaultConfig()
+    d := NewDispatcher(cfg)
+    d.Run()
+    t.Cleanup(func() {
+        if d.isRunning() {
+            ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+            defer cancel()
+            d.Stop(ctx)
+        }
+        db = saved
+    })
+
+    app := newApp(cfg, d)
+    send := func(method, path, body string) *httptest.ResponseRecorder {
+        w := httptest.NewRecorder()
+        app.route(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+        return w
+    }
+    return app, send
+}
+
+/* Registers active drivers of given ids in the store in use
+ */
+func registerDrivers(ids ...float64) {
+    for _, id := range ids {
+        db.CreateProfile(DriverProfile{Id: id, Name: fmt.Sprint("driver ", id), Active: true})
+    }
+}
+
+/* Waits till every driver in ids is found in the store
+ */
+func waitForDrivers(t *testing.T, ids []float64) {
+    deadline := time.Now().Add(5 * time.Second)
+    for _, id := range ids {
+        for {
+            if _, ok, _ := db.Get(id); ok {
+                break
+            }
+            if time.Now().After(deadline) {
+                t.Fatalf("Timed out waiting for driver %v to be written", id)
+            }
+            time.Sleep(time.Millisecond)
+        }
+    }
+}
+
+
+/* Tests that stopping the dispatcher waits for queued jobs to be applied
+ */
+func Test_dispatcher_stop_drains_queue(t *testing.T) {
+    if ok := initDB(defaultConfig()); !ok {
+        t.Fatal("Expected DB to initialise")
+    }
+    d := NewDispatcher(defaultConfig())
+    d.Run()
+
+    var ids []float64
+    for i := 1; i <= 2000; i++ {
+        ids = append(ids, float64(i))
+        if ok := d.Submit(Job{Payload: DriverStore{Id: float64(i), Latitude: 12.97, Longitude: 77.59}}); !ok {
+            t.Fatal("Expected job to be queued")
+        }
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    if err := d.Stop(ctx); err != nil {
+        t.Fatal("Expected queue to be drained, got ", err)
+    }
+    for _, id := range ids {
+        if _, ok, _ := db.Get(id); !ok {
+            t.Fatalf("Expected driver %v to be written before Stop returned", id)
+        }
+    }
+}
+
+
+/* Store recording the Timestamp of every update applied per driver,
+ * dawdling randomly so that racing workers would show up as reordering
+ */
+type orderStore struct {
+    fakeStore
+    mu      sync.Mutex
+    applied map[float64][]int64
+    gate    chan bool           // if set, every update is announced on it and then
+                                //waits for a value on it to go ahead
+}
+
+func (o *orderStore) Upsert(d DriverStore) error {
+    if o.gate != nil {
+        o.gate <- true
+        <-o.gate
+    }
+    time.Sleep(time.Duration(rand.Intn(50)) * time.Microsecond)
+    o.mu.Lock()
+    defer o.mu.Unlock()
+    o.applied[d.Id] = append(o.applied[d.Id], d.Timestamp)
+    return nil
+}
+
+/* Tests that updates of a driver are applied in the order they were queued,
+ * while many drivers are sending them concurrently. Updates coalesced while
+ * waiting are skipped, but the last one is always applied
+ */
+func Test_dispatcher_keeps_driver_order(t *testing.T) {
+    saved := db
+    defer func() { db = saved }()
+    store := &orderStore{applied: make(map[float64][]int64)}
+    db = store
+
+    d := NewDispatcher(defaultConfig())
+    d.Run()
+
+    const drivers, updates = 20, 100
+    var wg sync.WaitGroup
+    for id := 1; id <= drivers; id++ {
+        wg.Add(1)
+        go func(id int) {
+            defer wg.Done()
+            for ts := 1; ts <= updates; ts++ {
+                for !d.Submit(Job{Payload: DriverStore{Id: float64(id), Timestamp: int64(ts)}}) {
+                    time.Sleep(time.Millisecond)
+                }
+            }
+        }(id)
+    }
+    wg.Wait()
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    if err := d.Stop(ctx); err != nil {
+        t.Fatal("Expected queue to be drained, got ", err)
+    }
+    for id := 1; id <= drivers; id++ {
+        got := store.applied[float64(id)]
+        if len(got) == 0 || got[len(got)-1] != updates {
+            t.Fatalf("Expected last update of driver %v to be applied, got %v", id, got)
+        }
+        for i := 1; i < len(got); i++ {
+            if got[i] <= got[i-1] {
+                t.Fatalf("Expected updates of driver %v in order, got %v", id, got)
+            }
+        }
+    }
+}
+
+/* Tests that a burst of updates from a driver waiting behind a busy worker
+ * is collapsed into its latest one
+ */
+func Test_dispatcher_coalesces_updates(t *testing.T) {
+    saved := db
+    defer func() { db = saved }()
+    store := &orderStore{applied: make(map[float64][]int64), gate: make(chan bool)}
+    db = store
+
+    cfg := defaultConfig()
+    cfg.MaxWorkers = 1
+    d := NewDispatcher(cfg)
+    d.Run()
+
+    /* first update keeps the worker busy, rest of the burst waits in its mailbox */
+    for ts := 1; ts <= 50; ts++ {
+        if !d.Submit(Job{Payload: DriverStore{Id: 7, Timestamp: int64(ts)}}) {
+            t.Fatal("Expected job to be queued")
+        }
+        if ts == 1 {
+            <-store.gate
+        }
+    }
+    d.Submit(Job{Payload: DriverStore{Id: 7, Timestamp: 20}})      //late and older, never applied
+    deadline := time.Now().Add(5 * time.Second)
+    for atomic.LoadInt64(&d.coalesced) < 49 {
+        if time.Now().After(deadline) {
+            t.Fatal("Timed out waiting for updates to be coalesced, got ", atomic.LoadInt64(&d.coalesced))
+        }
+        time.Sleep(time.Millisecond)
+    }
+    store.gate <- true
+    <-store.gate            //the latest one reaches the store
+    store.gate <- true
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    if err := d.Stop(ctx); err != nil {
+        t.Fatal("Expected queue to be drained, got ", err)
+    }
+    if got := store.applied[7]; len(got) != 2 || got[0] != 1 || got[1] != 50 {
+        t.Error("Expected first and last update to be applied, got ", got)
+    }
+    if n := atomic.LoadInt64(&d.coalesced); n != 49 {
+        t.Error("Expected 49 updates collapsed, got ", n)
+    }
+}
+
+/* Tests that stores keep the newest location when an older update comes later
+ */
+func Test_stale_update_rejected(t *testing.T) {
+    mem := &memoryStore{}
+    sqlStore := &mysqlStore{driverName: "fakesql", dsn: t.Name()}
+    for _, s := range []Store{mem, sqlStore} {
+        if err := s.Init(); err != nil {
+            t.Fatal("Expected store to initialise, got ", err)
+        }
+        defer s.Close("")
+
+        if err := s.Upsert(DriverStore{Id: 1, Latitude: 12.97, Longitude: 77.59, Timestamp: 200}); err != nil {
+            t.Fatal("Expected nil, got ", err)
+        }
+        if err := s.Upsert(DriverStore{Id: 1, Latitude: 28.61, Longitude: 77.20, Timestamp: 100}); err != errStaleUpdate {
+            t.Error("Expected errStaleUpdate for older update, got ", err)
+        }
+        if d, _, _ := s.Get(1); d.Latitude != 12.97 || d.Timestamp != 200 {
+            t.Error("Expected newer location to be kept, got ", d)
+        }
+        if err := s.Upsert(DriverStore{Id: 1, Latitude: 12.98, Longitude: 77.59, Timestamp: 200}); err != nil {
+            t.Error("Expected update with same timestamp to be applied, got ", err)
+        }
+        if d, _, _ := s.Get(1); d.Latitude != 12.98 {
+            t.Error("Expected later of same timestamp to be kept, got ", d)
+        }
+    }
+}
+
+
+/* Tests the status changes allowed and that stores apply them and filter
+ * searches by status
+ */
+func Test_driver_status(t *testing.T) {
+    allowed := []struct{ from, to DriverStatus; ok bool }{
+                    {STATUS_AVAILABLE, STATUS_ON_TRIP, true},
+                    {STATUS_AVAILABLE, STATUS_OFFLINE, true},
+                    {STATUS_ON_TRIP, STATUS_AVAILABLE, true},
+                    {STATUS_ON_TRIP, STATUS_OFFLINE, false},
+                    {STATUS_OFFLINE, STATUS_AVAILABLE, true},
+                    {STATUS_OFFLINE, STATUS_ON_TRIP, false},
+                    {STATUS_ON_TRIP, STATUS_ON_TRIP, true},
+                }
+    for _, a := range allowed {
+        if canTransition(a.from, a.to) != a.ok {
+            t.Error("Expected change from ", a.from, " to ", a.to, " allowed to be ", a.ok)
+        }
+    }
+
+    mem := &memoryStore{}
+    sqlStore := &mysqlStore{driverName: "fakesql", dsn: t.Name()}
+    now := nowMillis()
+    for _, s := range []Store{mem, sqlStore} {
+        if err := s.Init(); err != nil {
+            t.Fatal("Expected store to initialise, got ", err)
+        }
+        defer s.Close("")
+
+        if _, err := s.SetStatus(1, STATUS_ON_TRIP); err != errDriverNotFound {
+            t.Error("Expected errDriverNotFound for unknown driver, got ", err)
+        }
+        s.Upsert(DriverStore{Id: 1, Latitude: 12.97, Longitude: 77.59, ReceivedAt: now, Timestamp: 1})
+        s.Upsert(DriverStore{Id: 2, Latitude: 12.97, Longitude: 77.59, ReceivedAt: now, Timestamp: 1})
+        if d, _, _ := s.Get(1); d.Status != STATUS_AVAILABLE {
+            t.Error("Expected new driver to be available, got ", d.Status)
+        }
+        if prev, err := s.SetStatus(1, STATUS_ON_TRIP); err != nil || prev != STATUS_AVAILABLE {
+            t.Error("Expected change to on_trip from available, got ", prev, err)
+        }
+        if prev, err := s.SetStatus(1, STATUS_OFFLINE); err != errBadTransition || prev != STATUS_ON_TRIP {
+            t.Error("Expected errBadTransition from on_trip, got ", prev, err)
+        }
+
+        /* location updates without status keep it */
+        s.Upsert(DriverStore{Id: 1, Latitude: 12.98, Longitude: 77.59, ReceivedAt: now, Timestamp: 2})
+        if d, _, _ := s.Get(1); d.Status != STATUS_ON_TRIP {
+            t.Error("Expected status kept by location update, got ", d.Status)
+        }
+
+        /* an update queued before status changed can not force a change no
+         * longer allowed; its location is still applied */
+        err := s.Upsert(DriverStore{Id: 1, Latitude: 12.99, Longitude: 77.59, ReceivedAt: now, Timestamp: 3,
+                                        Status: STATUS_OFFLINE})
+        if d, _, _ := s.Get(1); err != errBadTransition || d.Status != STATUS_ON_TRIP || d.Latitude != 12.99 {
+            t.Error("Expected location applied leaving status on_trip, got ", err, d)
+        }
+
+        v := Values{"lat": 12.97, "lon": 77.59, "rad": 5000, "lim": 10, "status": statusBit(STATUS_AVAILABLE)}
+        if results, _ := s.Nearest(v); len(results) != 1 || results[0].Id != 2 {
+            t.Error("Expected only available driver 2, got ", results)
+        }
+        v["status"] = statusBit(STATUS_ON_TRIP)
+        if results, _ := s.Nearest(v); len(results) != 1 || results[0].Id != 1 {
+            t.Error("Expected only driver 1 on trip, got ", results)
+        }
+        v["status"] = 0
+        if results, _ := s.Nearest(v); len(results) != 2 {
+            t.Error("Expected drivers of all statuses, got ", results)
+        }
+    }
+}
+
+/* Tests status endpoint, status in location updates and the status filter of
+ * 'GET /drivers'
+ */
+func Test_driver_status_endpoints(t *testing.T) {
+    _, send := newTestApp(t, &memoryStore{})
+    registerDrivers(1, 2)
+
+    if w := send("PUT", "/drivers/1/status", `{"status": "on_trip"}`); w.Code != 404 {
+        t.Error("Expected 404 for driver never seen, got ", w.Code, w.Body.String())
+    }
+    now := nowMillis()
+    db.Upsert(DriverStore{Id: 1, Latitude: 12.97, Longitude: 77.59, ReceivedAt: now, Timestamp: now})
+    db.Upsert(DriverStore{Id: 2, Latitude: 12.97, Longitude: 77.59, ReceivedAt: now, Timestamp: now})
+
+    if w := send("PUT", "/drivers/1/status", `{"status": "parked"}`); w.Code != 422 {
+        t.Error("Expected 422 for unknown status, got ", w.Code)
+    }
+    if w := send("GET", "/drivers/1/status", ``); w.Code != 405 {
+        t.Error("Expected 405 for GET, got ", w.Code)
+    }
+    w := send("PUT", "/drivers/1/status", `{"status": "on_trip"}`)
+    var resp DriverStatusResp
+    json.Unmarshal(w.Body.Bytes(), &resp)
+    if w.Code != 200 || resp != (DriverStatusResp{Id: 1, Status: "on_trip", Previous: "available"}) {
+        t.Error("Expected status changed, got ", w.Code, w.Body.String())
+    }
+    if w := send("PUT", "/drivers/1/status", `{"status": "offline"}`); w.Code != 409 {
+        t.Error("Expected 409 for going offline during trip, got ", w.Code, w.Body.String())
+    }
+    if w := send("PUT", "/drivers/1/location", `{"latitude": 12.97, "longitude": 77.59, "status": "offline"}`);
+            w.Code != 409 {
+        t.Error("Expected 409 for status in location update, got ", w.Code, w.Body.String())
+    }
+
+    search := func(query string) []DriverResp {
+        var drivers []DriverResp
+        w := send("GET", "/drivers?latitude=12.97&longitude=77.59" + query, ``)
+        json.Unmarshal(w.Body.Bytes(), &drivers)
+        return drivers
+    }
+    if d := search(""); len(d) != 1 || d[0].Id != 2 || d[0].Status != "available" {
+        t.Error("Expected only available driver by default, got ", d)
+    }
+    if d := search("&status=on_trip"); len(d) != 1 || d[0].Id != 1 || d[0].Status != "on_trip" {
+        t.Error("Expected only driver on trip, got ", d)
+    }
+    if d := search("&status=available,on_trip"); len(d) != 2 {
+        t.Error("Expected both drivers, got ", d)
+    }
+    if d := search("&status=all"); len(d) != 2 {
+        t.Error("Expected both drivers, got ", d)
+    }
+    if w := send("GET", "/drivers?latitude=12.97&longitude=77.59&status=busy", ``); w.Code != 400 {
+        t.Error("Expected 400 for unknown status, got ", w.Code)
+    }
+}
+
+/* Tests that stores keep vehicles apart from locations and filter searches on them
+ */
+func Test_vehicle_filters(t *testing.T) {
+    mem := &memoryStore{}
+    sqlStore := &mysqlStore{driverName: "fakesql", dsn: t.Name()}
+    now := nowMillis()
+    wheelchair, _ := featureMask([]string{"wheelchair"})
+    for _, s := range []Store{mem, sqlStore} {
+        if err := s.Init(); err != nil {
+            t.Fatal("Expected store to initialise, got ", err)
+        }
+        defer s.Close("")
+
+        s.SetVehicle(Vehicle{Id: 1, Class: VEHICLE_SEDAN, Seats: 4})
+        s.SetVehicle(Vehicle{Id: 2, Class: VEHICLE_XL, Seats: 6, Features: wheelchair})
+        s.SetVehicle(Vehicle{Id: 3, Class: VEHICLE_BIKE, Seats: 1})
+        for id := 1; id <= 4; id++ {
+            s.Upsert(DriverStore{Id: float64(id), Latitude: 12.97, Longitude: 77.59, ReceivedAt: now})
+        }
+        if d, _, _ := s.Get(2); d.Vehicle == nil || *d.Vehicle != (Vehicle{Id: 2, Class: VEHICLE_XL, Seats: 6,
+                                                                            Features: wheelchair}) {
+            t.Error("Expected vehicle along with driver, got ", d.Vehicle)
+        }
+        if d, _, _ := s.Get(4); d.Vehicle != nil {
+            t.Error("Expected no vehicle for driver 4, got ", d.Vehicle)
+        }
+
+        ids := func(filters Values) []float64 {
+            v := Values{"lat": 12.97, "lon": 77.59, "rad": 500, "lim": 10}
+            for k, f := range filters {
+                v[k] = f
+            }
+            results, _ := s.Nearest(v)
+            var found []float64
+            for _, d := range results {
+                found = append(found, d.Id)
+            }
+            return found
+        }
+        cases := []struct{ filters Values; expected []float64 }{
+                    {Values{}, []float64{1, 2, 3, 4}},
+                    {Values{"class": float64(classBit(VEHICLE_SEDAN) | classBit(VEHICLE_XL))}, []float64{1, 2}},
+                    {Values{"seats": 4}, []float64{1, 2}},
+                    {Values{"seats": 5}, []float64{2}},
+                    {Values{"features": float64(wheelchair)}, []float64{2}},
+                    {Values{"class": float64(classBit(VEHICLE_BIKE)), "seats": 2}, nil},
+                }
+        for _, c := range cases {
+            if found := ids(c.filters); !reflect.DeepEqual(found, c.expected) {
+                t.Error("Expected ", c.expected, " for ", c.filters, ", got ", found)
+            }
+        }
+
+        /* vehicle stays registered while driver is evicted for not updating */
+        s.Evict(now + 1)
+        s.Upsert(DriverStore{Id: 3, Latitude: 12.97, Longitude: 77.59, ReceivedAt: now})
+        if d, _, _ := s.Get(3); d.Vehicle == nil || d.Vehicle.Class != VEHICLE_BIKE {
+            t.Error("Expected vehicle to outlive eviction, got ", d.Vehicle)
+        }
+    }
+}
+
+/* Tests the vehicle endpoint and vehicle filters of 'GET /drivers'
+ */
+func Test_vehicle_endpoints(t *testing.T) {
+    _, send := newTestApp(t, &memoryStore{})
+    registerDrivers(1, 2)
+
+    bad := map[string]int{
+                `{"class": "limo", "seats": 4}`:                              422,
+                `{"class": "sedan", "seats": 0}`:                             422,
+                `{"class": "sedan", "seats": 4, "features": ["jacuzzi"]}`:    422,
+                `{"class": "sedan"`:                                          422,
+            }
+    for body, code := range bad {
+        if w := send("PUT", "/drivers/1/vehicle", body); w.Code != code {
+            t.Error("Expected ", code, " for ", body, ", got ", w.Code)
+        }
+    }
+    if w := send("PUT", "/drivers/3/vehicle", `{"class": "sedan", "seats": 4}`); w.Code != 404 {
+        t.Error("Expected 404 for driver not registered, got ", w.Code)
+    }
+    w := send("PUT", "/drivers/1/vehicle", `{"class": "xl", "seats": 6, "features": ["wheelchair"]}`)
+    if w.Code != 200 || strings.TrimSpace(w.Body.String()) != `{"class":"xl","seats":6,"features":["wheelchair"]}` {
+        t.Error("Expected vehicle registered, got ", w.Code, w.Body.String())
+    }
+    send("PUT", "/drivers/2/vehicle", `{"class": "sedan", "seats": 4}`)
+
+    now := nowMillis()
+    db.Upsert(DriverStore{Id: 1, Latitude: 12.97, Longitude: 77.59, ReceivedAt: now, Timestamp: now})
+    db.Upsert(DriverStore{Id: 2, Latitude: 12.97, Longitude: 77.59, ReceivedAt: now, Timestamp: now})
+    db.Upsert(DriverStore{Id: 3, Latitude: 12.97, Longitude: 77.59, ReceivedAt: now, Timestamp: now})
+
+    search := func(query string) []DriverResp {
+        var drivers []DriverResp
+        w := send("GET", "/drivers?latitude=12.97&longitude=77.59" + query, ``)
+        json.Unmarshal(w.Body.Bytes(), &drivers)
+        return drivers
+    }
+    if d := search(""); len(d) != 3 {
+        t.Error("Expected all drivers without filters, got ", d)
+    }
+    if d := search("&vehicle=sedan,hatchback"); len(d) != 1 || d[0].Id != 2 || d[0].Vehicle.Class != "sedan" {
+        t.Error("Expected only sedan, got ", d)
+    }
+    if d := search("&min_seats=5&features=wheelchair"); len(d) != 1 || d[0].Id != 1 {
+        t.Error("Expected only XL with wheelchair, got ", d)
+    }
+    for _, q := range []string{"&vehicle=limo", "&min_seats=0", "&min_seats=x", "&features=jacuzzi"} {
+        if w := send("GET", "/drivers?latitude=12.97&longitude=77.59" + q, ``); w.Code != 400 {
+            t.Error("Expected 400 for ", q, ", got ", w.Code)
+        }
+    }
+}
+
+/* Tests that a removed location leaves searches at once and that updates
+ * taken before the removal do not bring it back
+ */
+func Test_remove_location(t *testing.T) {
+    mem := &memoryStore{}
+    sqlStore := &mysqlStore{driverName: "fakesql", dsn: t.Name()}
+    now := nowMillis()
+    v := Values{"lat": 12.97, "lon": 77.59, "rad": 500, "lim": 10}
+    for _, s := range []Store{mem, sqlStore} {
+        if err := s.Init(); err != nil {
+            t.Fatal("Expected store to initialise, got ", err)
+        }
+        defer s.Close("")
+
+        if ok, err := s.RemoveLocation(1, now); ok || err != nil {
+            t.Error("Expected nothing to remove, got ", ok, err)
+        }
+        s.Upsert(DriverStore{Id: 1, Latitude: 12.97, Longitude: 77.59, ReceivedAt: now - 1000, Timestamp: 100})
+        if ok, err := s.RemoveLocation(1, now); !ok || err != nil {
+            t.Error("Expected location removed, got ", ok, err)
+        }
+        if _, ok, _ := s.Get(1); ok {
+            t.Error("Expected removed driver not to be found")
+        }
+        if d, ok, err := s.GetState(1); !ok || err != nil || !d.Removed || d.Timestamp != 100 ||
+                d.RemovedAt != now {
+            t.Error("Expected state of removed driver, got ", d, ok, err)
+        }
+        if results, _ := s.Nearest(v); len(results) != 0 {
+            t.Error("Expected removed driver out of search, got ", results)
+        }
+        if n, _ := s.Count(); n != 0 {
+            t.Error("Expected removed driver not counted, got ", n)
+        }
+        if _, err := s.SetStatus(1, STATUS_OFFLINE); err != errDriverNotFound {
+            t.Error("Expected errDriverNotFound for removed driver, got ", err)
+        }
+        if ok, _ := s.RemoveLocation(1, now + 10); ok {
+            t.Error("Expected nothing to remove again")
+        }
+        for _, ts := range []int64{50, 100} {
+            if err := s.Upsert(DriverStore{Id: 1, Latitude: 12.97, Longitude: 77.59, ReceivedAt: now,
+                                            Timestamp: ts}); err != errStaleUpdate {
+                t.Error("Expected errStaleUpdate for update taken at ", ts, ", got ", err)
+            }
+        }
+        /* received before the removal, though taken later on the device */
+        if err := s.Upsert(DriverStore{Id: 1, Latitude: 12.97, Longitude: 77.59, ReceivedAt: now,
+                                        Timestamp: 101}); err != errStaleUpdate {
+            t.Error("Expected errStaleUpdate for update received before removal, got ", err)
+        }
+        if err := s.Upsert(DriverStore{Id: 1, Latitude: 12.97, Longitude: 77.59, ReceivedAt: now + 1,
+                                        Timestamp: 101}); err != nil {
+            t.Error("Expected later update to be applied, got ", err)
+        }
+        if results, _ := s.Nearest(v); len(results) != 1 {
+            t.Error("Expected driver back in search, got ", results)
+        }
+    }
+}
+
+/* Tests that an update received before a removal, but applied after it, does
+ * not bring the location back even if taken later on the device. Removal is
+ * made through another server sharing the store, while the update waits in
+ * the queue of this one
+ */
+func Test_update_queued_before_removal(t *testing.T) {
+    store := &gatedStore{memoryStore: &memoryStore{}, gate: make(chan bool)}
+    app, send := newTestApp(t, store)
+    registerDrivers(7)
+    now := nowMillis()
+    store.memoryStore.Upsert(DriverStore{Id: 7, Latitude: 12.97, Longitude: 77.59, ReceivedAt: now - 5000,
+                                            Timestamp: now - 5000})
+
+    if w := send("PUT", "/drivers/7/location", fmt.Sprintf(
+                `{"latitude": 12.98, "longitude": 77.59, "timestamp": %d}`, now + 2000)); w.Code != 200 {
+        t.Fatal("Expected update queued, got ", w.Code, w.Body.String())
+    }
+    d := NewDispatcher(app.cfg)
+    d.Run()
+    w := httptest.NewRecorder()
+    newApp(app.cfg, d).route(w, httptest.NewRequest("DELETE", "/drivers/7/location", nil))
+    if w.Code != 204 {
+        t.Fatal("Expected 204 for removing location, got ", w.Code, w.Body.String())
+    }
+    close(store.gate)
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    for _, d := range []*Dispatcher{app.dispatcher, d} {
+        if err := d.Stop(ctx); err != nil {
+            t.Fatal("Expected queue to be drained, got ", err)
+        }
+    }
+    if got, ok, _ := db.Get(7); ok {
+        t.Error("Expected location to stay removed, got ", got)
+    }
+}
+
+/* Tests reading a driver and removing its location over HTTP
+ */
+func Test_driver_endpoints(t *testing.T) {
+    _, send := newTestApp(t, &memoryStore{})
+
+    if w := send("GET", "/drivers/7", ""); w.Code != 404 {
+        t.Error("Expected 404 for driver without location, got ", w.Code)
+    }
+    now := nowMillis()
+    db.Upsert(DriverStore{Id: 7, Latitude: 12.97, Longitude: 77.59, AccOrDist: 0.7, ReceivedAt: now - 5000,
+                            Timestamp: now - 6000})
+    db.SetVehicle(Vehicle{Id: 7, Class: VEHICLE_BIKE, Seats: 1})
+
+    w := send("GET", "/drivers/7", "")
+    var d DriverDetailResp
+    json.Unmarshal(w.Body.Bytes(), &d)
+    expected := DriverDetailResp{Id: 7, Latitude: 12.97, Longitude: 77.59, Accuracy: 0.7, Timestamp: now - 6000,
+                                    ReceivedAt: now - 5000, Age: 5, Status: "available"}
+    vehicle := d.Vehicle
+    d.Vehicle = nil
+    if w.Code != 200 || d != expected || vehicle == nil || vehicle.Class != "bike" {
+        t.Error("Expected ", expected, ", got ", w.Code, w.Body.String())
+    }
+    if w := send("POST", "/drivers/7", ""); w.Code != 405 {
+        t.Error("Expected 405 for POST, got ", w.Code)
+    }
+
+    if w := send("DELETE", "/drivers/7/location", ""); w.Code != 204 {
+        t.Error("Expected 204 for removing location, got ", w.Code, w.Body.String())
+    }
+    if w := send("GET", "/drivers/7", ""); w.Code != 404 {
+        t.Error("Expected 404 after removing location, got ", w.Code)
+    }
+    if w := send("GET", "/drivers?latitude=12.97&longitude=77.59", ""); strings.TrimSpace(w.Body.String()) != "[]" {
+        t.Error("Expected driver out of search, got ", w.Body.String())
+    }
+    if w := send("DELETE", "/drivers/7/location", ""); w.Code != 404 {
+        t.Error("Expected 404 for removing again, got ", w.Code)
+    }
+
+    /* an update older than the removal is reported ignored, not accepted */
+    registerDrivers(7)
+    w = send("PUT", "/drivers/7/location", fmt.Sprintf(
+                `{"latitude": 12.97, "longitude": 77.59, "timestamp": %d}`, now - 7000))
+    var resp DriverUpdateResp
+    json.Unmarshal(w.Body.Bytes(), &resp)
+    if w.Code != 200 || !resp.Ignored {
+        t.Error("Expected update older than removal ignored, got ", w.Code, w.Body.String())
+    }
+    if w := send("GET", "/drivers/7", ""); w.Code != 404 {
+        t.Error("Expected 404 for removed driver, got ", w.Code)
+    }
+
+    /* deactivating a driver takes it off search too */
+    registerDrivers(8)
+    db.Upsert(DriverStore{Id: 8, Latitude: 12.97, Longitude: 77.59, ReceivedAt: now, Timestamp: now})
+    if w := send("DELETE", "/drivers/8/profile", ""); w.Code != 200 {
+        t.Error("Expected driver deactivated, got ", w.Code)
+    }
+    if w := send("GET", "/drivers/8", ""); w.Code != 404 {
+        t.Error("Expected no location for deactivated driver, got ", w.Code)
+    }
+}
+
+/* Tests 'POST /drivers/locations' with array and NDJSON bodies, rejecting bad
+ * items one by one while queueing the rest
+ */
+func Test_batch_locations(t *testing.T) {
+    app, sendTo := newTestApp(t, &memoryStore{})
+    app.cfg.MaxBatchItems = 5
+    registerDrivers(1, 2, 3, 4)
+    send := func(method, body string) (*httptest.ResponseRecorder, BatchResp) {
+        w := sendTo(method, "/drivers/locations", body)
+        var resp BatchResp
+        json.Unmarshal(w.Body.Bytes(), &resp)
+        return w, resp
+    }
 
-    queries := []string {
-                    "latitude=12&longitude=77&radius=200000&limit=2",       //valid
-                    "latitude=220&longitude=77&radius=200000&limit=2",      //invalid
-                    "latitude=12&longitude=-777&radius=200000&limit=2",     //invalid
-                    "latitude=12&longitude=77&radius=-200&limit=2",         //invalid
-                    "latitude=12&longitude=77&radius=18000000&limit=2",     //invalid
-                    "latitude=12&longitude=77&radius=200000&limit=51000",   //invalid
-                }
+    now := nowMillis()
+    w, resp := send("POST", fmt.Sprintf(`[
+        {"id": 1, "latitude": 12.97, "longitude": 77.59, "accuracy": 0.7, "timestamp": %d},
+        {"id": 2, "latitude": 91, "longitude": 77.59},
+        {"id": 9, "latitude": 12.97, "longitude": 77.59},
+        {"id": 3, "latitude": "north"},
+        {"id": 4, "latitude": 12.98, "longitude": 77.60, "timestamp": %d}]`, now - 2000, now + 60000))
+    expected := []BatchItemResp{{0, 1, 200, false, ""}, {1, 2, 422, false, "Latitude should be between +/- 90"},
+                                {2, 9, 404, false, "Driver is not registered"}, {3, 0, 422, false, "Item format not valid"},
+                                {4, 4, 422, false, "Timestamp should not be ahead of server time"}}
+    if w.Code != 200 || resp.Accepted != 1 || resp.Rejected != 4 || !reflect.DeepEqual(resp.Results, expected) {
+        t.Error("Expected ", expected, ", got ", w.Code, w.Body.String())
+    }
+    waitForDrivers(t, []float64{1})
+    if got, _, _ := db.Get(1); got.Timestamp != now - 2000 || got.ReceivedAt < now {
+        t.Error("Expected device timestamp stored, got ", got)
+    }
 
-    for i, q := range queries {
-        r.URL.RawQuery = q 
-        _, errStr, _ := validateGetDriverParams(&r)
-        if i==0 && len(errStr) > 0 {
-            t.Error("Expected nil for GetRequest, got error - ", errStr)
-        } 
-        if i > 0 && len(errStr) == 0 {
-            t.Error("Expected error for GetRequest number -  ", i)
+    ndjson := `{"id": 2, "latitude": 12.97, "longitude": 77.59}` + "\n" +
+                `{"id": 3, "latitude": 12.97, "longitude": 77.59, "status": "offline"}` + "\n"
+    if w, resp := send("POST", ndjson); w.Code != 200 || resp.Accepted != 2 || len(resp.Results) != 2 {
+        t.Error("Expected 2 items of NDJSON accepted, got ", w.Code, w.Body.String())
+    }
+    waitForDrivers(t, []float64{2, 3})
+
+    bad := map[string]int{`[{"id": 1}`: 422, `[]`: 422, ``: 422, `{"id": 1} {`: 422, `[1,2,3,4,5,6]`: 413}
+    for body, code := range bad {
+        if w, _ := send("POST", body); w.Code != code {
+            t.Error("Expected ", code, " for ", body, ", got ", w.Code)
         }
     }
+
+    /* a body beyond max_batch_bytes is refused whatever its count of items */
+    app.cfg.MaxBatchBytes = 100
+    long := `[` + strings.Repeat(`{"id": 4, "latitude": 12.97, "longitude": 77.59}, `, 3) + `{"id": 4}]`
+    if w, _ := send("POST", long); w.Code != 413 || !strings.Contains(w.Body.String(), "at most 100 bytes") {
+        t.Error("Expected 413 for body over 100 bytes, got ", w.Code, w.Body.String())
+    }
+    if w, resp := send("POST", `[{"id": 4, "latitude": 12.97, "longitude": 77.59}]`); w.Code != 200 || resp.Accepted != 1 {
+        t.Error("Expected batch within 100 bytes accepted, got ", w.Code, w.Body.String())
+    }
+    if w, _ := send("PUT", `[]`); w.Code != 405 {
+        t.Error("Expected 405 for PUT, got ", w.Code)
+    }
 }
 
+/* Tests device timestamps of 'PUT /drivers/{id}/location' - checked against
+ * server time, stored with location and updates older than stored ignored
+ */
+func Test_device_timestamp(t *testing.T) {
+    app, send := newTestApp(t, &memoryStore{})
+    cfg := app.cfg
+    registerDrivers(7)
+    put := func(ts int64, status string) *httptest.ResponseRecorder {
+        body := fmt.Sprintf(`{"latitude": 12.97, "longitude": 77.59, "accuracy": 0.7, "timestamp": %d, "status": "%s"}`,
+                                ts, status)
+        return send("PUT", "/drivers/7/location", body)
+    }
+
+    now := nowMillis()
+    if w := put(now + 2000, ""); w.Code != 200 || w.Body.Len() != 0 {
+        t.Error("Expected 200 for timestamp within skew, got ", w.Code, w.Body.String())
+    }
+    waitForDrivers(t, []float64{7})
+    if got, _, _ := db.Get(7); got.Timestamp != now + 2000 || got.ReceivedAt > now + 1000 {
+        t.Error("Expected device timestamp stored, got ", got)
+    }
 
-/* Tests the validation function for PUT requests
+    stale := atomic.LoadInt64(&staleUpdates)
+    w := put(now - 1000, "offline")
+    var resp DriverUpdateResp
+    json.Unmarshal(w.Body.Bytes(), &resp)
+    if w.Code != 200 || !resp.Ignored || resp.StoredTimestamp != now + 2000 {
+        t.Error("Expected older update ignored, got ", w.Code, w.Body.String())
+    }
+    if n := atomic.LoadInt64(&staleUpdates) - stale; n != 1 {
+        t.Error("Expected ignored update counted as stale, got ", n)
+    }
+    if got, _, _ := db.Get(7); got.Status != STATUS_AVAILABLE {
+        t.Error("Expected status of ignored update left out, got ", got.Status)
+    }
+
+    for _, ts := range []int64{now + 60000, now - int64(cfg.DriverTTLSec + 10) * 1000} {
+        if w := put(ts, ""); w.Code != 422 {
+            t.Error("Expected 422 for timestamp ", ts - now, " ms off, got ", w.Code)
+        }
+    }
+    cfg.MaxClockSkewMs = 0
+    if w := put(nowMillis() + 1000, ""); w.Code != 422 {
+        t.Error("Expected 422 for timestamp ahead with no skew allowed, got ", w.Code)
+    }
+
+    /* a batch reports ignored items apart from accepted ones */
+    cfg.MaxClockSkewMs = 5000
+    body := fmt.Sprintf(`[{"id": 7, "latitude": 1, "longitude": 1, "timestamp": %d},
+                          {"id": 7, "latitude": 1, "longitude": 1, "timestamp": %d}]`, now - 500, now + 3000)
+    w = send("POST", "/drivers/locations", body)
+    var batch BatchResp
+    json.Unmarshal(w.Body.Bytes(), &batch)
+    if batch.Accepted != 1 || batch.Ignored != 1 || !batch.Results[0].Ignored || batch.Results[0].Code != 200 {
+        t.Error("Expected one item ignored and one accepted, got ", w.Body.String())
+    }
+
+    /* removal is on the clock of the device for when the location was taken, so
+     * one behind the server can come back once received after the removal */
+    registerDrivers(8)
+    send8 := func(method string, ts int64) *httptest.ResponseRecorder {
+        return send(method, "/drivers/8/location", fmt.Sprintf(
+                    `{"latitude": 12.97, "longitude": 77.59, "timestamp": %d}`, ts))
+    }
+    behind := nowMillis() - 4000
+    send8("PUT", behind)
+    waitForDrivers(t, []float64{8})
+    if w := send8("DELETE", 0); w.Code != 204 {
+        t.Fatal("Expected 204 for removing location, got ", w.Code, w.Body.String())
+    }
+    resp = DriverUpdateResp{}
+    w = send8("PUT", behind)
+    json.Unmarshal(w.Body.Bytes(), &resp)
+    if w.Code != 200 || !resp.Ignored || resp.StoredTimestamp != behind {
+        t.Error("Expected update no later than removal ignored, got ", w.Code, w.Body.String())
+    }
+    time.Sleep(2 * time.Millisecond)
+    if w := send8("PUT", behind + 1000); w.Code != 200 || w.Body.Len() != 0 {
+        t.Error("Expected later update accepted, got ", w.Code, w.Body.String())
+    }
+    waitForDrivers(t, []float64{8})
+    if got, _, _ := db.Get(8); got.Timestamp != behind + 1000 {
+        t.Error("Expected driver back with later update, got ", got)
+    }
+}
+
+/* Tests that items of a batch beyond capacity of dispatcher are refused alone
  */
-func Test_validate_put_request(t *testing.T) {
+func Test_batch_locations_overload(t *testing.T) {
+    saved := db
+    defer func() { db = saved }()
+    store := &stalledStore{release: make(chan bool)}
+    db = store
 
-    var r http.Request
-    var u url.URL
-    r.Method = "PUT"
-    r.URL = &u
-    r.URL.Path = "/drivers/123/location"
+    cfg := defaultConfig()
+    cfg.MaxQueue = 2
+    d := NewDispatcher(cfg)
+    d.Run()
+    app := newApp(cfg, d)
 
-    putData := []string {
-                    `{ "latitude": 12.97161923, "longitude":  77.59463452, "accuracy": 0.7 }`,     //valid                   
-                    `{ "latitude":212.97161923, "longitude":  77.59463452, "accuracy": 0.7 }`,     //invalid
-                    `{ "latitude": 12.97161923, "longitude":-777.59463452, "accuracy": 0.7 }`,     //invalid
-                    `{ "latitude": 12.97161923, "longitude":  77.59463452, "accuracy": 1.7 }`,     //invalid
+    body := `{"id": 1, "latitude": 12.97, "longitude": 77.59}
+             {"id": 2, "latitude": 12.97, "longitude": 77.59}
+             {"id": 3, "latitude": 12.97, "longitude": 77.59}`
+    w := httptest.NewRecorder()
+    app.route(w, httptest.NewRequest("POST", "/drivers/locations", strings.NewReader(body)))
+    var resp BatchResp
+    json.Unmarshal(w.Body.Bytes(), &resp)
+    if w.Code != 200 || resp.Accepted != 2 || resp.Rejected != 1 || resp.Results[2].Code != 503 {
+        t.Error("Expected last item refused for overload, got ", w.Code, w.Body.String())
+    }
+    if ra := w.Header().Get("Retry-After"); ra != "1" {
+        t.Error("Expected Retry-After of 1 sec, got ", ra)
+    }
+
+    close(store.release)
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    if err := d.Stop(ctx); err != nil {
+        t.Fatal("Expected queue to be drained, got ", err)
+    }
+}
+
+/* Tests that history keeps the latest points of each driver within per driver
+ * and fleet limits, and prunes old ones
+ */
+func Test_location_history(t *testing.T) {
+    cfg := defaultConfig()
+    cfg.HistoryPoints, cfg.HistoryMaxAgeSec, cfg.HistoryMaxTotalPoints = 3, 60, 4
+    h := newLocationHistory(cfg)
+    for ts := int64(1); ts <= 5; ts++ {
+        h.Add(DriverStore{Id: 1, Latitude: float64(ts), Timestamp: ts * 1000})
+    }
+    timestamps := func(ps []trailPoint) []int64 {
+        res := []int64{}
+        for _, p := range ps {
+            res = append(res, p.Timestamp)
+        }
+        return res
+    }
+    if got := timestamps(h.Trail(1, 0, 10000)); !reflect.DeepEqual(got, []int64{3000, 4000, 5000}) {
+        t.Error("Expected last 3 points, got ", got)
+    }
+    if got := timestamps(h.Trail(1, 3500, 4000)); !reflect.DeepEqual(got, []int64{4000}) {
+        t.Error("Expected points within range, got ", got)
+    }
+    if got := h.Trail(2, 0, 10000); got == nil || len(got) != 0 {
+        t.Error("Expected empty trail for driver without history, got ", got)
+    }
+
+    /* fleet limit of 4 leaves room for one point of driver 2 and none of 3 */
+    h.Add(DriverStore{Id: 2, Timestamp: 1000})
+    h.Add(DriverStore{Id: 2, Timestamp: 2000})
+    h.Add(DriverStore{Id: 3, Timestamp: 2000})
+    if got := timestamps(h.Trail(2, 0, 10000)); !reflect.DeepEqual(got, []int64{2000}) {
+        t.Error("Expected newer point to replace older at fleet limit, got ", got)
+    }
+    if len(h.Trail(3, 0, 10000)) != 0 || h.held != 4 || h.dropped != 1 {
+        t.Error("Expected point of driver 3 dropped, got ", h.held, h.dropped)
+    }
+
+    if n := h.Prune(63500); n != 2 || h.held != 2 {
+        t.Error("Expected 2 points pruned, got ", n, h.held)
+    }
+    if got := timestamps(h.Trail(1, 0, 10000)); !reflect.DeepEqual(got, []int64{4000, 5000}) {
+        t.Error("Expected points within max age kept, got ", got)
+    }
+    h.Add(DriverStore{Id: 3, Timestamp: 64000})
+    if len(h.Trail(3, 0, 70000)) != 1 {
+        t.Error("Expected pruning to make room for driver 3")
+    }
+
+    cfg.HistoryPoints = 0
+    if newLocationHistory(cfg) != nil {
+        t.Error("Expected history disabled for 0 points")
+    }
+}
+
+/* Tests that a trail overwritten at fleet limit before being full stays in
+ * order once pruning frees room for it to grow again
+ */
+func Test_location_history_after_fleet_limit(t *testing.T) {
+    cfg := defaultConfig()
+    cfg.HistoryPoints, cfg.HistoryMaxAgeSec, cfg.HistoryMaxTotalPoints = 4, 60, 4
+    h := newLocationHistory(cfg)
+    timestamps := func(id float64) []int64 {
+        res := []int64{}
+        for _, p := range h.Trail(id, 0, 100000) {
+            res = append(res, p.Timestamp)
+        }
+        return res
+    }
+
+    h.Add(DriverStore{Id: 1, Timestamp: 10000})
+    h.Add(DriverStore{Id: 1, Timestamp: 20000})
+    h.Add(DriverStore{Id: 2, Timestamp: 500})
+    h.Add(DriverStore{Id: 2, Timestamp: 600})
+    h.Add(DriverStore{Id: 1, Timestamp: 30000})         // fleet limit reached, 10000 makes way
+    if got := timestamps(1); !reflect.DeepEqual(got, []int64{20000, 30000}) {
+        t.Error("Expected oldest point replaced at fleet limit, got ", got)
+    }
+
+    /* pruning driver 2 frees room for driver 1 to grow */
+    if n := h.Prune(61000); n != 2 || h.held != 2 {
+        t.Error("Expected points of driver 2 pruned, got ", n, h.held)
+    }
+    h.Add(DriverStore{Id: 1, Timestamp: 40000})
+    h.Add(DriverStore{Id: 1, Timestamp: 50000})
+    if got := timestamps(1); !reflect.DeepEqual(got, []int64{20000, 30000, 40000, 50000}) {
+        t.Error("Expected points in order after growing, got ", got)
+    }
+    if n := h.Prune(85000); n != 1 {
+        t.Error("Expected oldest point pruned, got ", n)
+    }
+    if got := timestamps(1); !reflect.DeepEqual(got, []int64{30000, 40000, 50000}) {
+        t.Error("Expected points within max age kept in order, got ", got)
+    }
+}
+
+/* Tests 'GET /drivers/{id}/trail' in both formats, with history filled as
+ * workers apply updates
+ */
+func Test_trail_endpoint(t *testing.T) {
+    savedHistory := history
+    defer func() { history = savedHistory }()
+    app, send := newTestApp(t, &memoryStore{})
+    history = newLocationHistory(app.cfg)
+    get := func(path string) *httptest.ResponseRecorder {
+        return send("GET", path, "")
+    }
+
+    now := nowMillis()
+    for i, ts := range []int64{now - 3000, now - 1000, now - 2000, now} {
+        (Job{Payload: DriverStore{Id: 7, Latitude: 12.97 + float64(i) / 100, Longitude: 77.59, AccOrDist: 0.5,
+                                    ReceivedAt: now, Timestamp: ts}}).WriteToDB()
+    }
+
+    w := get(fmt.Sprintf("/drivers/7/trail?from=%d", now - 2500))
+    var tr TrailResp
+    json.Unmarshal(w.Body.Bytes(), &tr)
+    if w.Code != 200 || len(tr.Points) != 2 || tr.Points[0].Timestamp != now - 1000 || tr.Points[1].Latitude != 13 {
+        t.Error("Expected 2 points applied within range, got ", w.Code, w.Body.String())
+    }
+
+    w = get("/drivers/7/trail?format=geojson")
+    var f struct {
+        Type        string
+        Geometry    struct {
+            Type        string
+            Coordinates [][]float64
+        }
+        Properties  struct {
+            Id          int
+            Timestamps  []int64
+        }
+    }
+    json.Unmarshal(w.Body.Bytes(), &f)
+    if w.Code != 200 || w.Header().Get("Content-Type") != "application/geo+json" || f.Type != "Feature" ||
+            f.Geometry.Type != "LineString" || len(f.Geometry.Coordinates) != 3 ||
+            f.Geometry.Coordinates[0][0] != 77.59 || f.Properties.Id != 7 || len(f.Properties.Timestamps) != 3 {
+        t.Error("Expected LineString of 3 points, got ", w.Code, w.Body.String())
+    }
+    if w := get("/drivers/8/trail?format=geojson"); !strings.Contains(w.Body.String(), `"geometry":null`) {
+        t.Error("Expected null geometry for driver without history, got ", w.Body.String())
+    }
+
+    bad := []string{"/drivers/7/trail?from=x", "/drivers/7/trail?to=x", "/drivers/7/trail?from=2&to=1",
+                        "/drivers/7/trail?format=kml"}
+    for _, path := range bad {
+        if w := get(path); w.Code != 400 {
+            t.Error("Expected 400 for ", path, ", got ", w.Code)
+        }
+    }
+    history = nil
+    if w := get("/drivers/7/trail"); w.Code != 404 {
+        t.Error("Expected 404 with history disabled, got ", w.Code)
+    }
+}
+
+/* Tests that stores register, update and read back driver profiles
+ */
+func Test_driver_registry(t *testing.T) {
+    mem := &memoryStore{registry: true}
+    sqlStore := &mysqlStore{driverName: "fakesql", dsn: t.Name(), registry: true}
+    for _, s := range []Store{mem, sqlStore} {
+        if err := s.Init(); err != nil {
+            t.Fatal("Expected store to initialise, got ", err)
+        }
+        defer s.Close("")
+
+        p := DriverProfile{Id: 7, Name: "Asha", Phone: "+91 98450 12345", Active: true, CreatedAt: 10, UpdatedAt: 10}
+        if err := s.CreateProfile(p); err != nil {
+            t.Fatal("Expected profile to be created, got ", err)
+        }
+        if err := s.CreateProfile(DriverProfile{Id: 7, Name: "Other"}); err != errDriverExists {
+            t.Error("Expected errDriverExists, got ", err)
+        }
+        if err := s.UpdateProfile(DriverProfile{Id: 8, Name: "Nobody"}); err != errDriverNotFound {
+            t.Error("Expected errDriverNotFound, got ", err)
+        }
+        if _, ok, err := s.GetProfile(8); ok || err != nil {
+            t.Error("Expected no profile for driver 8, got ", ok, err)
+        }
+
+        p.Active, p.UpdatedAt = false, 20
+        if err := s.UpdateProfile(p); err != nil {
+            t.Error("Expected profile to be updated, got ", err)
+        }
+        if got, ok, err := s.GetProfile(7); !ok || err != nil || got != p {
+            t.Error("Expected ", p, ", got ", got, ok, err)
+        }
+        if err := s.Upsert(DriverStore{Id: 7, Latitude: 12.97, Longitude: 77.59, Timestamp: 30}); err != errDriverInactive {
+            t.Error("Expected update of deactivated driver refused, got ", err)
+        }
+        if _, ok, _ := s.Get(7); ok {
+            t.Error("Expected no location for deactivated driver")
+        }
+    }
+
+    /* range mode does not look at the registry */
+    legacy := &memoryStore{}
+    legacy.Init()
+    legacy.CreateProfile(DriverProfile{Id: 7, Name: "Asha"})
+    if err := legacy.Upsert(DriverStore{Id: 7, Latitude: 12.97, Longitude: 77.59, Timestamp: 30}); err != nil {
+        t.Error("Expected update applied in range mode, got ", err)
+    }
+}
+
+/* Tests that an update queued before its driver is deactivated, here by
+ * another server sharing the store, does not bring the driver back
+ */
+func Test_update_queued_before_deactivation(t *testing.T) {
+    store := &gatedStore{memoryStore: &memoryStore{registry: true}, gate: make(chan bool)}
+    app, send := newTestApp(t, store)
+    registerDrivers(7)
+    now := nowMillis()
+    store.memoryStore.Upsert(DriverStore{Id: 7, Latitude: 12.97, Longitude: 77.59, ReceivedAt: now - 5000,
+                                            Timestamp: now - 5000})
+
+    if w := send("PUT", "/drivers/7/location", `{"latitude": 12.98, "longitude": 77.59}`); w.Code != 200 {
+        t.Fatal("Expected update queued, got ", w.Code, w.Body.String())
+    }
+    p, _, _ := db.GetProfile(7)
+    p.Active = false
+    db.UpdateProfile(p)
+    db.RemoveLocation(7, nowMillis())
+    close(store.gate)
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    if err := app.dispatcher.Stop(ctx); err != nil {
+        t.Fatal("Expected queue to be drained, got ", err)
+    }
+    if d, ok, _ := db.Get(7); ok {
+        t.Error("Expected deactivated driver to stay without location, got ", d)
+    }
+    if w := send("GET", "/drivers?latitude=12.98&longitude=77.59", ""); strings.TrimSpace(w.Body.String()) != "[]" {
+        t.Error("Expected deactivated driver out of search, got ", w.Body.String())
+    }
+}
+
+/* Tests profile endpoints and that only active registered drivers, or ones in
+ * id range for legacy mode, can send updates
+ */
+func Test_driver_registry_endpoints(t *testing.T) {
+    app, send := newTestApp(t, &memoryStore{})
+    location := `{"latitude": 12.97, "longitude": 77.59, "accuracy": 0.7}`
+
+    if w := send("PUT", "/drivers/5/location", location); w.Code != 404 {
+        t.Error("Expected 404 for driver not registered, got ", w.Code)
+    }
+    w := send("POST", "/drivers/5/profile", `{"name": " Asha ", "phone": "+91 98450 12345"}`)
+    var p DriverProfile
+    json.Unmarshal(w.Body.Bytes(), &p)
+    if w.Code != 201 || p.Id != 5 || p.Name != "Asha" || !p.Active || p.CreatedAt == 0 {
+        t.Error("Expected driver registered, got ", w.Code, w.Body.String())
+    }
+    if w := send("POST", "/drivers/5/profile", `{"name": "Asha"}`); w.Code != 409 {
+        t.Error("Expected 409 for registering again, got ", w.Code)
+    }
+    bad := []string{`{"name": ""}`, `{"name": "Asha", "phone": "call me"}`, `{"name": "Asha", "active": false}`, `{`}
+    for _, body := range bad {
+        if w := send("POST", "/drivers/6/profile", body); w.Code != 422 {
+            t.Error("Expected 422 for ", body, ", got ", w.Code)
+        }
+    }
+    if w := send("PATCH", "/drivers/5/profile", `{}`); w.Code != 405 {
+        t.Error("Expected 405 for PATCH, got ", w.Code)
+    }
+    if w := send("PUT", "/drivers/5/location", location); w.Code != 200 {
+        t.Error("Expected 200 for registered driver, got ", w.Code, w.Body.String())
+    }
+
+    if w := send("PUT", "/drivers/5/profile", `{"name": "Asha K", "phone": "98450-12345"}`); w.Code != 200 {
+        t.Error("Expected profile updated, got ", w.Code, w.Body.String())
+    }
+    if w := send("GET", "/drivers/5/profile", ``); !strings.Contains(w.Body.String(), `"name":"Asha K"`) {
+        t.Error("Expected updated profile, got ", w.Code, w.Body.String())
+    }
+    if w := send("GET", "/drivers/6/profile", ``); w.Code != 404 {
+        t.Error("Expected 404 for profile not registered, got ", w.Code)
+    }
+    if w := send("PUT", "/drivers/6/profile", `{"name": "Nobody"}`); w.Code != 404 {
+        t.Error("Expected 404 for updating profile not registered, got ", w.Code)
+    }
+
+    /* deactivated drivers are kept but can not send updates till taken back */
+    if w := send("DELETE", "/drivers/5/profile", ``); w.Code != 200 || !strings.Contains(w.Body.String(), `"active":false`) {
+        t.Error("Expected driver deactivated, got ", w.Code, w.Body.String())
+    }
+    for _, path := range []string{"/drivers/5/location", "/drivers/5/status", "/drivers/5/vehicle"} {
+        if w := send("PUT", path, `{"latitude": 1, "status": "offline", "class": "sedan", "seats": 4}`); w.Code != 404 {
+            t.Error("Expected 404 for deactivated driver at ", path, ", got ", w.Code)
+        }
+    }
+    send("PUT", "/drivers/5/profile", `{"name": "Asha K", "active": true}`)
+    if w := send("PUT", "/drivers/5/location", location); w.Code != 200 {
+        t.Error("Expected 200 for driver taken back, got ", w.Code, w.Body.String())
+    }
+
+    /* legacy mode only checks the id range */
+    app.cfg.DriverIdMode = DRIVER_IDS_RANGE
+    if w := send("PUT", "/drivers/42/location", location); w.Code != 200 {
+        t.Error("Expected 200 for id in range, got ", w.Code, w.Body.String())
+    }
+    if w := send("PUT", "/drivers/50001/location", location); w.Code != 404 {
+        t.Error("Expected 404 for id out of range, got ", w.Code)
+    }
+}
+
+/* Tests that a status change waits for the updates of the driver queued
+ * before it, and that replay of write-ahead log applies them in that order too
+ */
+func Test_status_change_waits_for_queued_updates(t *testing.T) {
+    dir, err := ioutil.TempDir("", "wal")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    snap := filepath.Join(dir, "drivers.snapshot")
+
+    savedWal := wal
+    defer func() { wal = savedWal }()
+    store := &gatedStore{memoryStore: &memoryStore{}, gate: make(chan bool)}
+    app, sendTo := newTestApp(t, store)
+    if wal, err = openWAL(dir, snap); err != nil {
+        t.Fatal("Expected nil, got ", err)
+    }
+    registerDrivers(7)
+    now := nowMillis()
+    store.memoryStore.Upsert(DriverStore{Id: 7, Latitude: 12.97, Longitude: 77.59, ReceivedAt: now, Timestamp: now})
+    send := func(path, body string) *httptest.ResponseRecorder {
+        return sendTo("PUT", path, body)
+    }
+
+    /* on_trip is queued first, so going offline right after is not allowed */
+    if w := send("/drivers/7/location", `{"latitude": 12.98, "longitude": 77.59, "status": "on_trip"}`); w.Code != 200 {
+        t.Fatal("Expected update queued, got ", w.Code, w.Body.String())
+    }
+    done := make(chan *httptest.ResponseRecorder)
+    go func() { done <- send("/drivers/7/status", `{"status": "offline"}`) }()
+    select {
+        case w := <-done:
+            t.Fatal("Expected status change to wait for queued update, got ", w.Code, w.Body.String())
+        case <-time.After(100 * time.Millisecond):
+    }
+    close(store.gate)
+    if w := <-done; w.Code != 409 {
+        t.Error("Expected 409 for going offline during trip, got ", w.Code, w.Body.String())
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    if err := app.dispatcher.Stop(ctx); err != nil {
+        t.Fatal("Expected queue to be drained, got ", err)
+    }
+    live, _, _ := db.Get(7)
+    if live.Status != STATUS_ON_TRIP || live.Latitude != 12.98 {
+        t.Error("Expected location applied with driver on trip, got ", live)
+    }
+
+    /* crash, and replay into a fresh store */
+    wal.Sync()
+    wal.cur.file.Close()
+    db = &memoryStore{}
+    db.Init()
+    registerDrivers(7)
+    if wal, err = openWAL(dir, snap); err != nil {
+        t.Fatal("Expected nil, got ", err)
+    }
+    defer wal.Close()
+    if got, _, _ := db.Get(7); got.Status != live.Status {
+        t.Error("Expected replayed status ", live.Status, ", got ", got.Status)
+    }
+}
+
+/* memoryStore whose Upserts wait till gate is closed */
+type gatedStore struct {
+    *memoryStore
+    gate chan bool
+}
+
+func (s *gatedStore) Upsert(d DriverStore) error {
+    <-s.gate
+    return s.memoryStore.Upsert(d)
+}
+
+/* Tests that a status change is not lost when its location update is
+ * collapsed into a newer one
+ */
+func Test_mailbox_keeps_status(t *testing.T) {
+    m := newMailbox()
+    m.put(Job{Payload: DriverStore{Id: 1, Timestamp: 1, Status: STATUS_OFFLINE}})
+    m.put(Job{Payload: DriverStore{Id: 1, Timestamp: 2}})
+    if job, _ := m.take(); job.Payload.Timestamp != 2 || job.Payload.Status != STATUS_OFFLINE {
+        t.Error("Expected newer update carrying status, got ", job.Payload)
+    }
+
+    m.put(Job{Payload: DriverStore{Id: 1, Timestamp: 5}})
+    m.put(Job{Payload: DriverStore{Id: 1, Timestamp: 4, Status: STATUS_ON_TRIP}})
+    if job, _ := m.take(); job.Payload.Timestamp != 5 || job.Payload.Status != STATUS_ON_TRIP {
+        t.Error("Expected waiting update to take status of older one, got ", job.Payload)
+    }
+
+    /* a change of status is kept in its place between updates, which are not coalesced across it */
+    m.put(Job{Payload: DriverStore{Id: 1, Timestamp: 6}})
+    m.put(Job{Payload: DriverStore{Id: 1, Status: STATUS_OFFLINE}, Kind: WAL_STATUS})
+    m.put(Job{Payload: DriverStore{Id: 2, Timestamp: 6}})
+    m.put(Job{Payload: DriverStore{Id: 1, Timestamp: 7}})
+    if m.len() != 4 {
+        t.Error("Expected 4 jobs waiting, got ", m.len())
+    }
+    var taken []string
+    for job, ok := m.take(); ok; job, ok = m.take() {
+        taken = append(taken, fmt.Sprintf("%v %s %v", job.Payload.Id, job.Kind, job.Payload.Timestamp))
+    }
+    if expected := []string{"1  6", "2  6", "1 status 0", "1  7"}; !reflect.DeepEqual(taken, expected) {
+        t.Error("Expected jobs of driver in order, got ", taken)
+    }
+}
+
+
+/* Store whose updates hang till release is closed, standing in for a stalled DB
+ */
+type stalledStore struct {
+    fakeStore
+    release chan bool
+    applied int64
+}
+
+func (s *stalledStore) Upsert(d DriverStore) error {
+    <-s.release
+    atomic.AddInt64(&s.applied, 1)
+    return nil
+}
+
+/* Load test flooding PUTs while the store is stalled. Dispatcher should take
+ * in only max_queue updates without spawning go routines for the rest, which
+ * get 503 with Retry-After; and every update taken in is applied once the
+ * store recovers
+ */
+func Test_overload_returns_503(t *testing.T) {
+    saved := db
+    defer func() { db = saved }()
+    store := &stalledStore{release: make(chan bool)}
+    db = store
+
+    cfg := defaultConfig()
+    cfg.MaxQueue = 100
+    d := NewDispatcher(cfg)
+    d.Run()
+    app := newApp(cfg, d)
+    goroutines := runtime.NumGoroutine()
+
+    var wg sync.WaitGroup
+    var accepted, refused int64
+    for g := 0; g < 8; g++ {
+        wg.Add(1)
+        go func(g int) {
+            defer wg.Done()
+            for i := 1; i <= 250; i++ {
+                body := `{"latitude": 12.97, "longitude": 77.59, "accuracy": 0.7}`
+                w := httptest.NewRecorder()
+                app.route(w, httptest.NewRequest("PUT", fmt.Sprintf("/drivers/%v/location", g*1000+i), strings.NewReader(body)))
+                switch w.Code {
+                    case 200:
+                        atomic.AddInt64(&accepted, 1)
+                    case 503:
+                        atomic.AddInt64(&refused, 1)
+                        if ra := w.Header().Get("Retry-After"); ra != "1" {
+                            t.Error("Expected Retry-After of 1 sec, got ", ra)
+                        }
+                    default:
+                        t.Error("Expected 200 or 503, got ", w.Code, w.Body.String())
                 }
+            }
+        }(g)
+    }
+    wg.Wait()
 
-    for i, d := range putData {
-        r.Body = ioutil.NopCloser(strings.NewReader(d))
+    if accepted != 100 || refused != 1900 {
+        t.Error("Expected 100 accepted and 1900 refused, got ", accepted, refused)
+    }
+    if n := runtime.NumGoroutine(); n > goroutines + 5 {
+        t.Errorf("Expected go routines to stay bounded, got %v from %v", n, goroutines)
+    }
 
-        _, errStr, _ := validatePutDriverParams(&r)
-        if i==0 && len(errStr) > 0 {
-            t.Error("Expected nil for PutRequest, got error - ", errStr)
-        } 
-        if i > 0 && len(errStr) == 0 {
-            t.Error("Expected error for PutRequest number -  ", i)
+    close(store.release)
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    if err := d.Stop(ctx); err != nil {
+        t.Fatal("Expected queue to be drained, got ", err)
+    }
+    if n := atomic.LoadInt64(&store.applied); n != 100 {
+        t.Error("Expected 100 updates applied, got ", n)
+    }
+}
+
+
+/* Tests that each dispatcher keeps count of its own pending jobs, so that a
+ * full one neither refuses jobs of another nor holds up its Stop
+ */
+func Test_dispatchers_count_own_jobs(t *testing.T) {
+    saved := db
+    defer func() { db = saved }()
+    store := &stalledStore{release: make(chan bool)}
+    db = store
+
+    cfg := defaultConfig()
+    cfg.MaxQueue = 2
+    full, other, idle := NewDispatcher(cfg), NewDispatcher(cfg), NewDispatcher(cfg)
+    for _, d := range []*Dispatcher{full, other, idle} {
+        d.Run()
+    }
+    for id := 1; id <= 2; id++ {
+        full.Submit(Job{Payload: DriverStore{Id: float64(id)}})
+    }
+    if full.Submit(Job{Payload: DriverStore{Id: 3}}) {
+        t.Error("Expected full dispatcher to refuse job")
+    }
+    if !other.Submit(Job{Payload: DriverStore{Id: 4}}) || other.fillPct() != 50 {
+        t.Error("Expected other dispatcher to take job, got fill ", other.fillPct())
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+    defer cancel()
+    if err := idle.Stop(ctx); err != nil {
+        t.Error("Expected idle dispatcher to stop right away, got ", err)
+    }
+
+    close(store.release)
+    ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    for _, d := range []*Dispatcher{full, other} {
+        if err := d.Stop(ctx); err != nil {
+            t.Fatal("Expected queue to be drained, got ", err)
         }
     }
+    if n := atomic.LoadInt64(&store.applied); n != 3 {
+        t.Error("Expected 3 updates applied, got ", n)
+    }
+}
+
+/* Stress test for the in memory store with writers and readers in parallel.
+ * Meaningful when run with race detector -
+ *      $ go test -race
+ */
+func Test_concurrent_store_access(t *testing.T) {
+    m := &memoryStore{}
+    m.Init()
+
+    var wg sync.WaitGroup
+    for g := 0; g < 8; g++ {
+        wg.Add(2)
+        go func(g int) {
+            defer wg.Done()
+            for i := 0; i < 1000; i++ {
+                m.Upsert(DriverStore{Id: float64(i%100 + 1), Latitude: 12.9 + float64(g)*0.01,
+                                        Longitude: 77.5 + float64(i)*0.0001})
+            }
+        }(g)
+        go func() {
+            defer wg.Done()
+            for i := 0; i < 200; i++ {
+                m.Nearest(Values{"lat": 12.95, "lon": 77.55, "rad": 10000, "lim": 10})
+                m.Get(float64(i%100 + 1))
+            }
+        }()
+    }
+    wg.Wait()
+
+    if results, _ := m.Nearest(Values{"lat": 12.95, "lon": 77.55, "rad": 50000, "lim": 200}); len(results) != 100 {
+        t.Error("Expected 100 drivers, got ", len(results))
+    }
 }
 
 
+/* Stress test sending PUT and GET requests in parallel through the
+ * handlers, dispatcher and workers. Run with -race as above.
+ */
+func Test_concurrent_put_and_get(t *testing.T) {
+    if ok := initDB(defaultConfig()); !ok {
+        t.Fatal("Expected DB to initialise")
+    }
+    app := testApp()
+
+    var wg sync.WaitGroup
+    var ids []float64
+    for g := 0; g < 8; g++ {
+        for i := 1; i <= 200; i++ {
+            ids = append(ids, float64(g*1000+i))
+        }
+        registerDrivers(ids[len(ids)-200:]...)
+        wg.Add(2)
+        go func(g int) {
+            defer wg.Done()
+            for i := 1; i <= 200; i++ {
+                body := fmt.Sprintf(`{"latitude": %v, "longitude": 77.59, "accuracy": 0.7}`, 12.9+float64(i)*0.0005)
+                w := httptest.NewRecorder()
+                app.route(w, httptest.NewRequest("PUT", fmt.Sprintf("/drivers/%v/location", g*1000+i), strings.NewReader(body)))
+                if w.Code != 200 {
+                    t.Error("Expected 200 for PUT, got ", w.Code, w.Body.String())
+                }
+            }
+        }(g)
+        go func() {
+            defer wg.Done()
+            for i := 0; i < 100; i++ {
+                w := httptest.NewRecorder()
+                app.route(w, httptest.NewRequest("GET", "/drivers?latitude=12.95&longitude=77.59&radius=5000&limit=20", nil))
+                if w.Code != 200 {
+                    t.Error("Expected 200 for GET, got ", w.Code, w.Body.String())
+                }
+            }
+        }()
+    }
+    wg.Wait()
+    waitForDrivers(t, ids)
+}
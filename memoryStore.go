@@ -0,0 +1,340 @@
+package main
+
+/*
+ * STORE_IN_MEMORY implementation of the DB wrapper.
+ * Driver details are kept in a map keyed by driver id and their
+ * positions in a gridIndex which is updated on every Upsert.
+ *
+ * Workers write into the store while HTTP handlers search it, so
+ * drivers are split into MEMORY_SHARDS shards on their id, each
+ * with its own map, grid and RW lock. Writers only lock the shard
+ * of the driver they update and searches take the read lock of one
+ * shard at a time, so neither blocks the whole store.
+ * Vehicles and profiles are kept in maps of their own in the shard of
+ * the driver, which eviction leaves alone.
+ */
+
+import (
+    "sync"
+    "sync/atomic"
+)
+
+func init() {
+    registerStore(STORE_IN_MEMORY, func(cfg *Config) Store {
+        return &memoryStore{registry: cfg.DriverIdMode == DRIVER_IDS_REGISTRY}
+    })
+}
+
+type memoryShard struct {
+    mu      sync.RWMutex
+    drivers  map[float64]DriverStore
+    vehicles map[float64]Vehicle
+    profiles map[float64]DriverProfile
+    grid     *gridIndex
+}
+
+/* registry tells if updates of deactivated drivers are refused, as in
+ * DRIVER_IDS_REGISTRY mode
+ */
+type memoryStore struct {
+    shards   []*memoryShard
+    registry bool
+}
+
+func (m *memoryStore) Init() error {
+    m.shards = make([]*memoryShard, MEMORY_SHARDS)
+    for i := range m.shards {
+        m.shards[i] = &memoryShard{
+                        drivers:  make(map[float64]DriverStore),
+                        vehicles: make(map[float64]Vehicle),
+                        profiles: make(map[float64]DriverProfile),
+                        grid:     newGridIndex(GRID_CELL_DEGREES),
+                    }
+    }
+    return nil
+}
+
+func (m *memoryStore) shardOf(id float64) *memoryShard {
+    return m.shards[uint64(id)%uint64(len(m.shards))]
+}
+
+func (m *memoryStore) Upsert(d DriverStore) error {
+    sh := m.shardOf(d.Id)
+    sh.mu.Lock()
+    defer sh.mu.Unlock()
+
+    d.Vehicle = nil                 // read from sh.vehicles, never kept in drivers
+    if p, found := sh.profiles[d.Id]; m.registry && found && !p.Active {
+        return errDriverInactive
+    }
+    old, ok := sh.drivers[d.Id]
+    if ok && isStaleUpdate(d.Timestamp, d.ReceivedAt, old) {
+        return errStaleUpdate
+    }
+    var err error
+    if ok && d.Status != "" && !canTransition(old.Status, d.Status) {
+        d.Status, err = "", errBadTransition
+    }
+    if d.Status == "" {
+        d.Status = STATUS_AVAILABLE
+        if ok {
+            d.Status = old.Status
+        }
+    }
+
+    /* only the located drivers are in grid */
+    switch {
+        case ok && !old.Removed && !d.Removed:
+            sh.grid.move(d.Id, old.Latitude, old.Longitude, d.Latitude, d.Longitude)
+        case ok && !old.Removed:
+            sh.grid.remove(d.Id, old.Latitude, old.Longitude)
+        case !d.Removed:
+            sh.grid.add(d.Id, d.Latitude, d.Longitude)
+    }
+    sh.drivers[d.Id] = d
+    return err
+}
+
+/* The record is kept with Removed set, out of grid, till evicted
+ */
+func (m *memoryStore) RemoveLocation(id float64, at int64) (bool, error) {
+    sh := m.shardOf(id)
+    sh.mu.Lock()
+    defer sh.mu.Unlock()
+
+    d, ok := sh.drivers[id]
+    if !ok || d.Removed {
+        return false, nil
+    }
+    sh.grid.remove(id, d.Latitude, d.Longitude)
+    d.Removed, d.RemovedAt = true, at
+    sh.drivers[id] = d
+    return true, nil
+}
+
+func (m *memoryStore) SetStatus(id float64, status DriverStatus) (DriverStatus, error) {
+    sh := m.shardOf(id)
+    sh.mu.Lock()
+    defer sh.mu.Unlock()
+
+    d, ok := sh.drivers[id]
+    if !ok || d.Removed {
+        return "", errDriverNotFound
+    }
+    if !canTransition(d.Status, status) {
+        return d.Status, errBadTransition
+    }
+    prev := d.Status
+    d.Status = status
+    sh.drivers[id] = d
+    return prev, nil
+}
+
+func (m *memoryStore) SetVehicle(v Vehicle) error {
+    sh := m.shardOf(v.Id)
+    sh.mu.Lock()
+    defer sh.mu.Unlock()
+
+    sh.vehicles[v.Id] = v
+    return nil
+}
+
+func (m *memoryStore) CreateProfile(p DriverProfile) error {
+    sh := m.shardOf(p.Id)
+    sh.mu.Lock()
+    defer sh.mu.Unlock()
+
+    if _, ok := sh.profiles[p.Id]; ok {
+        return errDriverExists
+    }
+    sh.profiles[p.Id] = p
+    return nil
+}
+
+func (m *memoryStore) UpdateProfile(p DriverProfile) error {
+    sh := m.shardOf(p.Id)
+    sh.mu.Lock()
+    defer sh.mu.Unlock()
+
+    if _, ok := sh.profiles[p.Id]; !ok {
+        return errDriverNotFound
+    }
+    sh.profiles[p.Id] = p
+    return nil
+}
+
+func (m *memoryStore) GetProfile(id float64) (DriverProfile, bool, error) {
+    sh := m.shardOf(id)
+    sh.mu.RLock()
+    defer sh.mu.RUnlock()
+
+    p, ok := sh.profiles[id]
+    return p, ok, nil
+}
+
+/* Returns vehicle of driver id in shard sh, nil if not registered.
+ * Shard should be locked by caller
+ */
+func (sh *memoryShard) vehicleOf(id float64) *Vehicle {
+    if v, ok := sh.vehicles[id]; ok {
+        return &v
+    }
+    return nil
+}
+
+func (m *memoryStore) Get(id float64) (DriverStore, bool, error) {
+    sh := m.shardOf(id)
+    sh.mu.RLock()
+    defer sh.mu.RUnlock()
+
+    d, ok := sh.drivers[id]
+    if !ok || d.Removed {
+        return DriverStore{}, false, nil
+    }
+    d.Vehicle = sh.vehicleOf(id)
+    return d, true, nil
+}
+
+func (m *memoryStore) GetState(id float64) (DriverStore, bool, error) {
+    sh := m.shardOf(id)
+    sh.mu.RLock()
+    defer sh.mu.RUnlock()
+
+    d, ok := sh.drivers[id]
+    if !ok {
+        return DriverStore{}, false, nil
+    }
+    return DriverStore{Id: id, Timestamp: d.Timestamp, Status: d.Status, Removed: d.Removed,
+                        RemovedAt: d.RemovedAt}, true, nil
+}
+
+/* Extracts nearest drivers for given coordinates.
+ * Only the drivers in grid cells overlapping the bounding box of the search circle
+ * are visited and their distance in meters is calculated with given coordinates.
+ * If returned distance is less than provided radius value, it is offered to a
+ * nearestCollector which keeps the "lim" nearest of them.
+ * Drivers not updated since v["since"], not in status mask v["status"] or whose
+ * vehicle does not match the filters in v are skipped.
+ */
+func (m *memoryStore) Nearest(v Values) ([]DriverStore, error) {
+
+   /* TODO : we should handle the accuracy also by considering two values
+    * for each lat - min(=acc*lat) and max(=(1-acc)*lat). Same for lon.
+    * This is because accuracy indicates that driver may be present anywhere
+    * within latitude/longitude range {min, max} as calculated above
+    */
+
+    la := v["lat"]
+    lo := v["lon"]
+    ra := v["rad"]
+    c := newNearestCollector((int)(v["lim"]))
+
+    minLat, maxLat, minLon, maxLon := getRangeOfCoordinates(v)
+    scanned := 0
+    for _, sh := range m.shards {
+        sh.mu.RLock()
+        sh.grid.visit(minLat, maxLat, minLon, maxLon, func(id float64) bool {
+            scanned++
+            d := sh.drivers[id]
+            if float64(d.ReceivedAt) < v["since"] {
+                return true         // stale, waiting to be evicted
+            }
+            if !statusInMask(d.Status, v["status"]) {
+                return true
+            }
+            d.Vehicle = sh.vehicleOf(id)
+            if !vehicleMatches(d.Vehicle, v) {
+                return true
+            }
+            dis := Distance(la, lo, d.Latitude, d.Longitude)     //see above note-TODO for incorporating accuracy
+            if dis <= ra {
+                d.AccOrDist = dis        // reusing this field to return distance calculated
+                c.offer(d)
+            }
+            return true
+        })
+        sh.mu.RUnlock()
+    }
+    atomic.AddInt64(&nearestScanned, int64(scanned))
+    return c.sorted(), nil
+}
+
+func (m *memoryStore) Evict(before int64) (int, error) {
+    n := 0
+    for _, sh := range m.shards {
+        sh.mu.Lock()
+        for id, d := range sh.drivers {
+            if d.ReceivedAt < before {
+                if !d.Removed {
+                    sh.grid.remove(id, d.Latitude, d.Longitude)
+                    n++
+                }
+                delete(sh.drivers, id)
+            }
+        }
+        sh.mu.Unlock()
+    }
+    return n, nil
+}
+
+func (m *memoryStore) Count() (int, error) {
+    n := 0
+    for _, sh := range m.shards {
+        sh.mu.RLock()
+        for _, d := range sh.drivers {
+            if !d.Removed {
+                n++
+            }
+        }
+        sh.mu.RUnlock()
+    }
+    return n, nil
+}
+
+/* Returns a copy of all drivers, vehicles and profiles, one shard at a time
+ */
+func (m *memoryStore) Snapshot() snapshotData {
+    var all snapshotData
+    for _, sh := range m.shards {
+        sh.mu.RLock()
+        for _, d := range sh.drivers {
+            all.drivers = append(all.drivers, d)
+        }
+        for _, v := range sh.vehicles {
+            all.vehicles = append(all.vehicles, v)
+        }
+        for _, p := range sh.profiles {
+            all.profiles = append(all.profiles, p)
+        }
+        sh.mu.RUnlock()
+    }
+    return all
+}
+
+func (m *memoryStore) Restore(data snapshotData) error {
+    for _, d := range data.drivers {
+        if err := m.Upsert(d); err != nil {
+            return err
+        }
+    }
+    for _, v := range data.vehicles {
+        if err := m.SetVehicle(v); err != nil {
+            return err
+        }
+    }
+    for _, p := range data.profiles {
+        if err := m.CreateProfile(p); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+/* Writes a snapshot of the drivers to disk to sustain last populated values
+ */
+func (m *memoryStore) Close(f string) error {
+    if f == "" {
+        return nil
+    }
+    return writeSnapshot(f, m.Snapshot())
+}
@@ -0,0 +1,183 @@
+package main
+
+/*
+ * Metrics of this application exposed on 'GET /metrics' in Prometheus
+ * text exposition format, so that they can be scraped without pulling
+ * any client library.
+ *
+ * Counters are plain int64 updated atomically where the event happens;
+ * gauges like queue depth or store size are read at scrape time.
+ * HTTP requests are counted by MetricsMiddleware per route, method and
+ * status code along with a histogram of their latency.
+ */
+
+import (
+    "bufio"
+    "fmt"
+    "net/http"
+    "sort"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+/* Counters updated along the code path, see also the ones of Dispatcher */
+var (
+    dbWriteErrors   int64       // failed WriteToDB of jobs
+    staleUpdates    int64       // updates refused as older than stored location, by store or
+                                // before queueing
+    droppedStatuses int64       // status changes of updates left out by store as not allowed
+    nearestSearches int64       // calls to Store.Nearest
+    nearestScanned  int64       // drivers looked at by those calls before checking distance
+)
+
+/* Upper bounds in seconds of the buckets of request latency histogram.
+ * Target for a request is 100ms */
+var latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+type requestKey struct {
+    route   string
+    method  string
+    code    int
+}
+
+type requestStats struct {
+    count   uint64
+    sum     float64         // seconds
+    buckets []uint64        // count of requests within each of latencyBuckets
+}
+
+var requestMetrics = struct {
+    mu      sync.Mutex
+    stats   map[requestKey]*requestStats
+}{stats: make(map[requestKey]*requestStats)}
+
+/* Records a served request
+ */
+func observeRequest(route, method string, code int, latency time.Duration) {
+    key := requestKey{route: route, method: method, code: code}
+    secs := latency.Seconds()
+
+    requestMetrics.mu.Lock()
+    defer requestMetrics.mu.Unlock()
+    s, ok := requestMetrics.stats[key]
+    if !ok {
+        s = &requestStats{buckets: make([]uint64, len(latencyBuckets))}
+        requestMetrics.stats[key] = s
+    }
+    s.count++
+    s.sum += secs
+    for i, le := range latencyBuckets {
+        if secs <= le {
+            s.buckets[i]++
+        }
+    }
+}
+
+func MetricsMiddleware(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    t := time.Now()
+    rec := newResponseRecorder(w)
+    next.ServeHTTP(rec, r)
+    observeRequest(routeName(r), r.Method, rec.status, time.Since(t))
+  })
+}
+
+/* Http Handler for 'GET /metrics'
+ * Inputs :
+ *      w - writer for response
+ *      r - HTTP request object
+ * Returns :
+ *      None
+ */
+func (a *App) metrics(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "GET" {
+        setHttpErrorWithJson(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+    bw := bufio.NewWriter(w)
+    defer bw.Flush()
+
+    writeRequestMetrics(bw)
+
+    if d := a.dispatcher; d != nil {
+        writeMetric(bw, "uber_jobs_pending", "gauge", "Updates queued or being applied by workers",
+                        atomic.LoadInt64(&d.pending))
+        busy := atomic.LoadInt64(&d.busy)
+        writeMetric(bw, "uber_job_queue_depth", "gauge", "Updates waiting for a worker", d.queueDepth())
+        fmt.Fprintf(bw, "# HELP uber_workers Workers by state\n# TYPE uber_workers gauge\n")
+        fmt.Fprintf(bw, "uber_workers{state=\"busy\"} %d\n", busy)
+        fmt.Fprintf(bw, "uber_workers{state=\"idle\"} %d\n", int64(len(d.workers)) - busy)
+        writeMetric(bw, "uber_coalesced_updates_total", "counter", "Updates left out for a newer one of same driver",
+                        atomic.LoadInt64(&d.coalesced))
+    }
+    writeMetric(bw, "uber_stale_updates_total", "counter", "Updates refused as older than stored location",
+                    atomic.LoadInt64(&staleUpdates))
+    writeMetric(bw, "uber_dropped_status_changes_total", "counter",
+                    "Status changes of updates left out as not allowed from status at the time of applying",
+                    atomic.LoadInt64(&droppedStatuses))
+    writeMetric(bw, "uber_db_write_errors_total", "counter", "Updates failed to be written in store",
+                    atomic.LoadInt64(&dbWriteErrors))
+    writeMetric(bw, "uber_nearest_searches_total", "counter", "Nearest driver searches made in store",
+                    atomic.LoadInt64(&nearestSearches))
+    writeMetric(bw, "uber_nearest_scanned_drivers_total", "counter", "Drivers scanned by nearest driver searches",
+                    atomic.LoadInt64(&nearestScanned))
+    if h := history; h != nil {
+        writeMetric(bw, "uber_history_points", "gauge", "Locations held in history of drivers",
+                        atomic.LoadInt64(&h.held))
+        writeMetric(bw, "uber_history_dropped_points_total", "counter", "Locations left out of history for fleet limit",
+                        atomic.LoadInt64(&h.dropped))
+    }
+    if db != nil {
+        if n, err := db.Count(); err == nil {
+            writeMetric(bw, "uber_store_drivers", "gauge", "Drivers in store", int64(n))
+        }
+    }
+}
+
+func writeMetric(w *bufio.Writer, name, kind, help string, value int64) {
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
+
+/* Writes request counts and latency histograms, ordered on labels so that
+ * the output is stable between scrapes
+ */
+func writeRequestMetrics(w *bufio.Writer) {
+    requestMetrics.mu.Lock()
+    defer requestMetrics.mu.Unlock()
+
+    keys := make([]requestKey, 0, len(requestMetrics.stats))
+    for k := range requestMetrics.stats {
+        keys = append(keys, k)
+    }
+    sort.Slice(keys, func(i, j int) bool {
+        if keys[i].route != keys[j].route {
+            return keys[i].route < keys[j].route
+        }
+        if keys[i].method != keys[j].method {
+            return keys[i].method < keys[j].method
+        }
+        return keys[i].code < keys[j].code
+    })
+    labels := func(k requestKey) string {
+        return fmt.Sprintf(`route="%s",method="%s",code="%d"`, k.route, k.method, k.code)
+    }
+
+    fmt.Fprintf(w, "# HELP uber_http_requests_total HTTP requests served\n# TYPE uber_http_requests_total counter\n")
+    for _, k := range keys {
+        fmt.Fprintf(w, "uber_http_requests_total{%s} %d\n", labels(k), requestMetrics.stats[k].count)
+    }
+
+    name := "uber_http_request_duration_seconds"
+    fmt.Fprintf(w, "# HELP %s Latency of HTTP requests\n# TYPE %s histogram\n", name, name)
+    for _, k := range keys {
+        s := requestMetrics.stats[k]
+        for i, le := range latencyBuckets {
+            fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels(k), le, s.buckets[i])
+        }
+        fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels(k), s.count)
+        fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels(k), s.sum)
+        fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels(k), s.count)
+    }
+}
@@ -4,21 +4,146 @@ package main
  * Data Models for this application
  */
 
+import (
+    "context"
+    "math"
+    "sync"
+    "time"
+)
+
 
 /* Schema for receiving driver updates from 'Put /drivers/{id}/location' requests */
 type DriverUpdates struct {
     Latitude  float64   `json:"latitude"`
     Longitude float64   `json:"longitude"`
     Accuracy  float64   `json:"accuracy"`
+    Status    string    `json:"status"`     //optional, changes status of driver along with location
+    Timestamp int64     `json:"timestamp"`  //optional, unix ms when the device took the location;
+                                            //time of receiving otherwise
+}
+
+/* Schema of an item of 'POST /drivers/locations' requests */
+type DriverBatchItem struct {
+    Id        float64   `json:"id"`
+    DriverUpdates
+}
+
+/* Schema for responses to 'PUT /drivers/{id}/location' of an update ignored
+ * for being older than the stored location. Accepted updates get no body
+ */
+type DriverUpdateResp struct {
+    Ignored         bool    `json:"ignored"`
+    Reason          string  `json:"reason"`
+    StoredTimestamp int64   `json:"stored_timestamp"`   //unix ms of the stored location
+}
+
+/* Schema for receiving 'PUT /drivers/{id}/status' requests */
+type DriverStatusUpdate struct {
+    Status    string    `json:"status"`
+}
+
+/* Schema for receiving 'PUT /drivers/{id}/vehicle' requests, also used to
+ * show the vehicle in responses. Features are names in vehicleFeatures
+ */
+type DriverVehicle struct {
+    Class     string    `json:"class"`
+    Seats     int       `json:"seats"`
+    Features  []string  `json:"features"`
+}
+
+/* Schema for receiving '/drivers/{id}/profile' requests. Active is optional,
+ * only 'PUT' can set it, for ex. to take back a deactivated driver
+ */
+type DriverProfileUpdate struct {
+    Name      string    `json:"name"`
+    Phone     string    `json:"phone"`
+    Active    *bool     `json:"active"`
+}
+
+/* Schema for creating responses to 'PUT /drivers/{id}/status'
+ */
+type DriverStatusResp struct {
+    Id          int     `json:"id"`
+    Status      string  `json:"status"`
+    Previous    string  `json:"previous"`
+}
+
+/* Schema for creating responses to 'POST /drivers/locations'. Results are in
+ * order of the items sent; Code is the HTTP code the item would have got as
+ * a PUT of its own, with Error telling why it was rejected
+ */
+type BatchResp struct {
+    Accepted    int     `json:"accepted"`
+    Ignored     int     `json:"ignored"`    //older than stored location, see DriverUpdateResp
+    Rejected    int     `json:"rejected"`
+    Results     []BatchItemResp `json:"results"`
+}
+
+type BatchItemResp struct {
+    Index       int     `json:"index"`
+    Id          float64 `json:"id"`         //0 if item had no valid id
+    Code        int     `json:"code"`
+    Ignored     bool    `json:"ignored,omitempty"`
+    Error       string  `json:"error,omitempty"`
+}
+
+/* Schema for creating responses to 'GET /drivers/{id}'
+ */
+type DriverDetailResp struct {
+    Id          int     `json:"id"`
+    Latitude    float64 `json:"latitude"`
+    Longitude   float64 `json:"longitude"`
+    Accuracy    float64 `json:"accuracy"`
+    Timestamp   int64   `json:"timestamp"`      //unix ms when the location was taken
+    ReceivedAt  int64   `json:"received_at"`    //unix ms when the location was received
+    Age         int     `json:"age"`            //seconds since the location was received
+    Status      string  `json:"status"`
+    Vehicle     *DriverVehicle `json:"vehicle,omitempty"`
+}
+
+/* Schema for creating responses to 'GET /drivers/{id}/trail'
+ */
+type TrailResp struct {
+    Id          int     `json:"id"`
+    From        int64   `json:"from"`           //unix ms
+    To          int64   `json:"to"`             //unix ms
+    Points      []TrailPointResp `json:"points"`
+}
+
+type TrailPointResp struct {
+    Latitude    float64 `json:"latitude"`
+    Longitude   float64 `json:"longitude"`
+    Accuracy    float64 `json:"accuracy"`
+    Timestamp   int64   `json:"timestamp"`
+    ReceivedAt  int64   `json:"received_at"`
+}
+
+/* GeoJSON Feature for 'GET /drivers/{id}/trail?format=geojson'. Geometry is a
+ * LineString of [longitude, latitude] positions, or null with less than two
+ * points; properties carry id, from, to and timestamps of the positions
+ */
+type TrailFeature struct {
+    Type        string          `json:"type"`
+    Geometry    *LineString     `json:"geometry"`
+    Properties  map[string]interface{} `json:"properties"`
+}
+
+type LineString struct {
+    Type        string          `json:"type"`
+    Coordinates [][2]float64    `json:"coordinates"`
 }
 
 /* Schema for creating responses to 'GET /drivers'
+ * Distance is in meters, rounded to nearest integer
  */
 type DriverResp struct {
     Id          int     `json:"id"`
-    Latitude    string  `json:"latitude"`
-    Longitude   string  `json:"longitude"`
-    Distance    string  `json:"dist"`
+    Latitude    float64 `json:"latitude"`
+    Longitude   float64 `json:"longitude"`
+    Distance    int     `json:"distance"`
+    Age         int     `json:"age"`        //seconds since the location was received
+    Status      string  `json:"status"`
+    Vehicle     *DriverVehicle `json:"vehicle,omitempty"`     //if registered
 }
         
 /* Schema for receving request params in 'GET /drivers' 
@@ -40,6 +165,53 @@ type DriverStore struct {
     AccOrDist   float64  `json:"distance"`  //using this field to store accurracy while writing in DB and
                                             //as distance from provided coordinates while responding to 
                                             //nearestDriver request
+    ReceivedAt  int64    `json:"received_at"`   //server time(unix ms) when the location was received
+    Timestamp   int64    `json:"timestamp"`     //unix ms when the location was taken; orders the updates
+                                                //of a driver, an older one never replaces a newer one
+    Status      DriverStatus `json:"status,omitempty"`  //empty in an update leaves status as is
+    Vehicle     *Vehicle `json:"-"`     //filled by stores while reading, if registered; never
+                                        //written through Upsert, see Store.SetVehicle
+    Removed     bool     `json:"removed,omitempty"` //location taken at Timestamp was removed, see
+                                                    //Store.RemoveLocation; kept only to refuse
+                                                    //older updates till evicted
+    RemovedAt   int64    `json:"removed_at,omitempty"`  //server time(unix ms) of the removal
+}
+
+/* Profile of a registered driver as held by stores, also sent in responses.
+ * A deactivated driver is kept for records but can not send updates
+ */
+type DriverProfile struct {
+    Id          float64 `json:"id"`
+    Name        string  `json:"name"`
+    Phone       string  `json:"phone,omitempty"`
+    Active      bool    `json:"active"`
+    CreatedAt   int64   `json:"created_at"`     //unix ms
+    UpdatedAt   int64   `json:"updated_at"`     //unix ms
+}
+
+/* Vehicle of a driver as held by stores. Kept apart from the location so that it
+ * stays registered while the driver is evicted for not updating
+ */
+type Vehicle struct {
+    Id          float64      `json:"id"`
+    Class       VehicleClass `json:"class"`
+    Seats       int          `json:"seats"`
+    Features    int          `json:"features"`     //bit mask of vehicleFeatures
+}
+
+/* Schema for responses to 'GET /status'
+ */
+type StatusResp struct {
+    Ready           bool        `json:"ready"`
+    NotReady        []string    `json:"not_ready,omitempty"`     //reasons when not ready
+    Store           string      `json:"store"`
+    Drivers         int         `json:"drivers"`                 //-1 if store could not count
+    Workers         int         `json:"workers"`
+    BusyWorkers     int64       `json:"busy_workers"`
+    QueueDepth      int64       `json:"queue_depth"`             //updates waiting for a worker
+    PendingJobs     int64       `json:"pending_jobs"`            //updates waiting or being applied
+    QueueCapacity   int64       `json:"queue_capacity"`
+    UptimeSec       int64       `json:"uptime_sec"`
 }
 
 /* Helper struct for converting a string error message into a json 
@@ -54,32 +226,139 @@ type DrivApis int
 const (
     GetDrivers = 1  
     PutDriver  = 2
+    PutStatus  = 3
+    PutVehicle = 4
+    GetDriver  = 5
+    DelDriver  = 6
+    GetTrail   = 7
 )
 
-/* Enum Simulation as enums are not available in Go 
+/* Status of a driver, see driverStatus.go for allowed changes
+ */
+type DriverStatus string
+const (
+    STATUS_AVAILABLE DriverStatus = "available"
+    STATUS_ON_TRIP   DriverStatus = "on_trip"
+    STATUS_OFFLINE   DriverStatus = "offline"
+)
+
+/* Products offered, a vehicle being of one of them
+ */
+type VehicleClass string
+const (
+    VEHICLE_HATCHBACK VehicleClass = "hatchback"
+    VEHICLE_SEDAN     VehicleClass = "sedan"
+    VEHICLE_XL        VehicleClass = "xl"
+    VEHICLE_BIKE      VehicleClass = "bike"
+)
+
+/* Values of Config.DriverIdMode
+ */
+const (
+    DRIVER_IDS_REGISTRY = "registry"
+    DRIVER_IDS_RANGE    = "range"
+)
+
+/* Names with which the stores register themselves, see registerStore()
  */
-type DBStores int
+type DBStores string
 const (
-    STORE_IN_MEMORY= 10 
-    STORE_MYSQL     = 11
+    STORE_IN_MEMORY = "memory"
+    STORE_MYSQL     = "mysql"
 )
 
-/* Configuration params for this application
+/* Configuration params for this application, loaded at startup by
+ * loadConfig() from defaults, config file, environment and flags.
+ * Defaults are in defaultConfig()
+ */
+type Config struct {
+    /* HTTP server */
+    ListenAddr          string  `json:"listen_addr"`
+
+    /* Logs, see logger.go. LogLevel is one of debug, info, warn or error and
+     * LogFormat text or json. Requests slower than SlowRequestMs are warned */
+    LogLevel            string  `json:"log_level"`
+    LogFormat           string  `json:"log_format"`
+    SlowRequestMs       int     `json:"slow_request_ms"`
+
+    /* Driver Attribute Defaults. DriverIdMode tells which drivers can send
+     * updates - registered and active ones, or in legacy mode any id from
+     * MinDriverId to MaxDriverId */
+    DriverIdMode        string  `json:"driver_id_mode"`
+    MinDriverId         int     `json:"min_driver_id"`
+    MaxDriverId         int     `json:"max_driver_id"`
+    Radius              float64 `json:"radius"`
+    Limit               int     `json:"limit"`
+
+    /* Worker/Dispatcher. At max MaxQueue updates can be pending with
+     * workers, beyond which PUTs get 503 asking to retry after RetryAfterSec */
+    MaxWorkers          int     `json:"max_workers"`
+    MaxQueue            int     `json:"max_queue"`
+    RetryAfterSec       int     `json:"retry_after_sec"`
+
+    /* Most items, and bytes of body, taken in one 'POST /drivers/locations' */
+    MaxBatchItems       int     `json:"max_batch_items"`
+    MaxBatchBytes       int     `json:"max_batch_bytes"`
+
+    /* How far ahead of server time a device timestamp of an update can be */
+    MaxClockSkewMs      int     `json:"max_clock_skew_ms"`
+
+    /* /readyz fails once pending updates reach this percent of MaxQueue */
+    ReadyQueueFillPct   int     `json:"ready_queue_fill_pct"`
+
+    /* Selected DB type, one of the names registered with registerStore() */
+    Store               string  `json:"store"`
+
+    /* SQL store connection, used only when Store is STORE_MYSQL */
+    SqlDriver           string  `json:"sql_driver"`
+    SqlDSN              string  `json:"sql_dsn"`
+
+    /* Snapshot of STORE_IN_MEMORY, loaded on start and saved periodically */
+    SnapshotPath        string  `json:"snapshot_path"`
+    SnapshotIntervalSec int     `json:"snapshot_interval_sec"`
+
+    /* Write-ahead log of location updates; empty WalDir disables it.
+     * Updates received within last sync interval may be lost in a crash */
+    WalDir              string  `json:"wal_dir"`
+    WalSyncIntervalMs   int     `json:"wal_sync_interval_ms"`
+
+    /* Drivers are expected to update every 60 sec. The ones not updated within
+     * DriverTTLSec are left out of searches and evicted by a sweeper running
+     * every SweepIntervalSec */
+    DriverTTLSec        int     `json:"driver_ttl_sec"`
+    SweepIntervalSec    int     `json:"sweep_interval_sec"`
+
+    /* Location history, see history.go. Each driver keeps at most HistoryPoints
+     * locations of last HistoryMaxAgeSec, and at most HistoryMaxTotalPoints are
+     * kept for the fleet. HistoryPoints of 0 disables it */
+    HistoryPoints           int `json:"history_points"`
+    HistoryMaxAgeSec        int `json:"history_max_age_sec"`
+    HistoryMaxTotalPoints   int `json:"history_max_total_points"`
+
+    /* On SIGINT/SIGTERM, /readyz fails for ReadyDrainSec while requests are
+     * still served, so that probes take the instance out of rotation; then
+     * ShutdownTimeoutSec is given to finish requests and queued jobs */
+    ReadyDrainSec       int     `json:"ready_drain_sec"`
+    ShutdownTimeoutSec  int     `json:"shutdown_timeout_sec"`
+}
+
+/* Internal tuning params, not expected to change between deployments
  */
-type config int
 const (
-    /* Driver Attribute Defaults */
-    MIN_DRIVER_ID = 1
-    MAX_DRIVER_ID = 50000
-    RADIUS = 500
-    LIMIT  = 10
-
-    /* Worker/Dispatcher Defaults */
-    MAX_WORKERS = 4
-    MAX_QUEUE = 50
-
-    /* Selected DB type */
-    CURRENT_DB = STORE_IN_MEMORY
+    /* Radius of Earth taken by Distance() */
+    EARTH_RADIUS = 6378100
+
+    /* Length of a degree of latitude on that radius, ~111.3km */
+    METERS_PER_DEGREE = EARTH_RADIUS * math.Pi / 180
+
+    /* Side of a gridIndex cell for STORE_IN_MEMORY, ~1.1km along latitude */
+    GRID_CELL_DEGREES = 0.01
+
+    /* Number of independently locked shards in STORE_IN_MEMORY */
+    MEMORY_SHARDS = 16
+
+    /* Most seats a vehicle can have, driver excluded */
+    MAX_VEHICLE_SEATS = 12
 )
 
 
@@ -88,6 +367,18 @@ const (
  * or extract results from DB to update cache  */
 type Job struct {
     Payload DriverStore
+    Kind    string          // "" for a location update, else WAL_STATUS or WAL_REMOVE for a
+                            // change of the driver made in its turn, see App.applyChange()
+    ctx     context.Context // carries id of the request that made this job, see detachContext()
+    walSeg  *walSegment     // segment of write-ahead log holding this job, if any
+    done    chan jobResult  // told the outcome, if a request waits on it
+}
+
+/* Outcome of a job, see Job.apply() */
+type jobResult struct {
+    prev    DriverStatus    // status before a WAL_STATUS change
+    removed bool            // whether a WAL_REMOVE change found a location
+    err     error
 }
 
 
@@ -95,28 +386,52 @@ type Job struct {
  * We should keep worker count to max number of cores
  * available across machines */
 type Worker struct {
-    WorkerPool  chan chan Job
-    JobChannel  chan Job
+    Mailbox     *mailbox        // jobs waiting for this worker, in order for every driver
+    dispatcher  *Dispatcher     // that this worker belongs to
     quit        chan bool
 }
 
 /* Dispatcher is responsible for asynchronously delegating received requests processing
- * as a Job to one of the workers
+ * as a Job to one of the workers.
+ * Every driver is always handled by the same worker, see workerOf(), so the
+ * updates of a driver are applied in the order they were queued
  */
 type Dispatcher struct {
-    // A pool of workers channels that are registered with the dispatcher
-    WorkerPool chan chan Job
+    // Counters updated atomically, kept first for 64 bit alignment -
+    // jobs queued but not yet applied by a worker, including the ones being
+    // applied, kept within capacity by Submit;
+    // jobs left out as a newer update of same driver was queued before they
+    // reached the store, see mailbox.go;
+    // workers applying jobs at the moment
+    pending    int64
+    coalesced  int64
+    busy       int64
+
+    // A buffered channel that we can send work requests on
+    JobQueue   chan Job
+
+    // Max jobs pending at a time, queued or with workers; beyond it
+    // requests are refused rather than piling up in memory
+    capacity   int64
+
+    // 1 between Run and Stop
+    running    int32
+
+    // Held by Submit so that jobs are in write-ahead log in order of JobQueue
+    submitMu   sync.Mutex
     maxWorkers int
+    workers    []Worker
+    quit       chan bool
 }
 
-/* A buffered channel that we can send work requests on 
- * Capacity is set to twice the support required but can
- * be kept at some other smaller multiple if MAX_DRIVER_ID
- * is too high
+/* App holds what the HTTP handlers need, built once at startup
  */
-var JobQueue = make(chan Job, 2*MAX_DRIVER_ID)
-
-var inMemDb map[float64]DriverStore
+type App struct {
+    cfg             *Config
+    dispatcher      *Dispatcher
+    started         time.Time
+    shuttingDown    int32       // set by shutdown(), turns /readyz down
+}
 
 
 /* 
@@ -0,0 +1,14 @@
+//go:build mysql
+// +build mysql
+
+package main
+
+/*
+ * Links the MySQL driver for database/sql into the binary.
+ * Kept behind the 'mysql' build tag so that default builds do not
+ * depend on any library outside of go installation.
+ */
+
+import (
+    _ "github.com/go-sql-driver/mysql"
+)
@@ -0,0 +1,397 @@
+package main
+
+/*
+ * STORE_MYSQL implementation of the DB wrapper.
+ * It talks to any MySQL compatible server through database/sql so that
+ * the driver locations survive restarts and can be shared between
+ * several instances of this server.
+ *
+ * Caveat : database/sql needs a driver to be registered for Config.SqlDriver.
+ * ------
+ * As we do not pull any external library by default, the driver is
+ * linked in only when building with the 'mysql' tag (see mysqlDriver.go) -
+ *      $ go install -tags mysql
+ */
+
+import (
+    "database/sql"
+    "sync/atomic"
+)
+
+func init() {
+    registerStore(STORE_MYSQL, func(cfg *Config) Store {
+        return &mysqlStore{driverName: cfg.SqlDriver, dsn: cfg.SqlDSN,
+                            registry: cfg.DriverIdMode == DRIVER_IDS_REGISTRY}
+    })
+}
+
+/* Statements used against the SQL store.
+ * Separate {lat,id} and {lon,id} tables are not needed as the indexes
+ * on latitude and longitude give the same narrowing of the scan
+ */
+const (
+    sqlCreateDrivers = `CREATE TABLE IF NOT EXISTS drivers (
+        id          BIGINT UNSIGNED NOT NULL PRIMARY KEY,
+        latitude    DOUBLE NOT NULL,
+        longitude   DOUBLE NOT NULL,
+        accuracy    DOUBLE NOT NULL,
+        received_at BIGINT NOT NULL,
+        timestamp   BIGINT NOT NULL,
+        status      VARCHAR(16) NOT NULL DEFAULT 'available',
+        removed     BOOLEAN NOT NULL DEFAULT FALSE,
+        removed_at  BIGINT NOT NULL DEFAULT 0,
+        INDEX idx_latitude (latitude),
+        INDEX idx_longitude (longitude),
+        INDEX idx_received_at (received_at))`
+
+    /* vehicles are kept in a table of their own as eviction of drivers should
+     * not remove them */
+    sqlCreateVehicles = `CREATE TABLE IF NOT EXISTS vehicles (
+        id          BIGINT UNSIGNED NOT NULL PRIMARY KEY,
+        class       VARCHAR(16) NOT NULL,
+        seats       INT NOT NULL,
+        features    INT NOT NULL)`
+
+    /* registry of drivers, see registry.go */
+    sqlCreateProfiles = `CREATE TABLE IF NOT EXISTS profiles (
+        id          BIGINT UNSIGNED NOT NULL PRIMARY KEY,
+        name        VARCHAR(100) NOT NULL,
+        phone       VARCHAR(20) NOT NULL,
+        active      BOOLEAN NOT NULL,
+        created_at  BIGINT NOT NULL,
+        updated_at  BIGINT NOT NULL)`
+
+    sqlProfileColumns = `id, name, phone, active, created_at, updated_at`
+
+    /* inserts nothing if id is taken, which is told by rows affected */
+    sqlInsertProfile = `INSERT IGNORE INTO profiles (` + sqlProfileColumns + `) VALUES (?, ?, ?, ?, ?, ?)`
+
+    sqlLockProfile = `SELECT id FROM profiles WHERE id = ? FOR UPDATE`
+
+    sqlUpdateProfile = `UPDATE profiles SET name = ?, phone = ?, active = ?, updated_at = ? WHERE id = ?`
+
+    sqlProfileById = `SELECT ` + sqlProfileColumns + ` FROM profiles WHERE id = ?`
+
+    /* holds off UpdateProfile of the driver till the transaction of Upsert ends */
+    sqlProfileActive = `SELECT active FROM profiles WHERE id = ? LOCK IN SHARE MODE`
+
+    sqlDriverFields = `id, latitude, longitude, accuracy, received_at, timestamp, status, removed, removed_at`
+
+    /* columns read into a DriverStore by scanDriver(), from sqlDriversJoined */
+    sqlDriverColumns = `d.id, d.latitude, d.longitude, d.accuracy, d.received_at, d.timestamp, d.status,
+        v.class, v.seats, v.features`
+    sqlDriversJoined = `drivers d LEFT JOIN vehicles v ON v.id = d.id`
+
+    sqlUpsertDriver = `INSERT INTO drivers (` + sqlDriverFields + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+        ON DUPLICATE KEY UPDATE latitude = VALUES(latitude), longitude = VALUES(longitude),
+        accuracy = VALUES(accuracy), received_at = VALUES(received_at), timestamp = VALUES(timestamp),
+        status = VALUES(status), removed = VALUES(removed), removed_at = VALUES(removed_at)`
+
+    sqlDriverState = `SELECT timestamp, status, removed, removed_at FROM drivers WHERE id = ?`
+
+    /* locks the row of driver till the transaction of Upsert or SetStatus ends */
+    sqlLockDriver = sqlDriverState + ` FOR UPDATE`
+
+    /* row is kept as a tombstone till evicted, see Store.RemoveLocation */
+    sqlRemoveLocation = `UPDATE drivers SET removed = TRUE, removed_at = ? WHERE id = ? AND NOT removed`
+
+    sqlSetDriverStatus = `UPDATE drivers SET status = ? WHERE id = ?`
+
+    sqlUpsertVehicle = `INSERT INTO vehicles (id, class, seats, features) VALUES (?, ?, ?, ?)
+        ON DUPLICATE KEY UPDATE class = VALUES(class), seats = VALUES(seats), features = VALUES(features)`
+
+    sqlDriverById = `SELECT ` + sqlDriverColumns + ` FROM ` + sqlDriversJoined + ` WHERE d.id = ? AND NOT d.removed`
+
+    /* vehicle filters are skipped when their params are 0, see vehicle.go */
+    sqlDriversInBox = `SELECT ` + sqlDriverColumns + ` FROM ` + sqlDriversJoined + `
+        WHERE d.latitude BETWEEN ? AND ? AND d.longitude BETWEEN ? AND ? AND d.received_at >= ?
+        AND NOT d.removed AND FIND_IN_SET(d.status, ?) > 0
+        AND (? = 0 OR FIND_IN_SET(v.class, ?) > 0)
+        AND (? = 0 OR v.seats >= ?)
+        AND (? = 0 OR v.features & ? = ?)`
+
+    sqlEvictDrivers = `DELETE FROM drivers WHERE received_at < ?`
+
+    sqlCountDrivers = `SELECT COUNT(*) FROM drivers WHERE NOT removed`
+)
+
+/* Implemented by both *sql.Row and *sql.Rows */
+type rowScanner interface {
+    Scan(dest ...interface{}) error
+}
+
+/* Reads a row of sqlDriverColumns; vehicle columns are NULL if not registered
+ */
+func scanDriver(row rowScanner) (DriverStore, error) {
+    var d DriverStore
+    var class sql.NullString
+    var seats, features sql.NullInt64
+    err := row.Scan(&d.Id, &d.Latitude, &d.Longitude, &d.AccOrDist, &d.ReceivedAt, &d.Timestamp, &d.Status,
+                        &class, &seats, &features)
+    if err == nil && class.Valid {
+        d.Vehicle = &Vehicle{Id: d.Id, Class: VehicleClass(class.String), Seats: int(seats.Int64),
+                                Features: int(features.Int64)}
+    }
+    return d, err
+}
+
+/* Connection settings are read while creating so that tests can point the
+ * store to some other driver. registry is as in memoryStore
+ */
+type mysqlStore struct {
+    driverName  string
+    dsn         string
+    registry    bool
+    conn        *sql.DB
+}
+
+/* Opens the SQL store and creates the schema if not already present
+ */
+func (m *mysqlStore) Init() error {
+    conn, err := sql.Open(m.driverName, m.dsn)
+    if err != nil {
+        return err
+    }
+    if err = conn.Ping(); err != nil {
+        conn.Close()
+        return err
+    }
+    for _, create := range []string{sqlCreateDrivers, sqlCreateVehicles, sqlCreateProfiles} {
+        if _, err = conn.Exec(create); err != nil {
+            conn.Close()
+            return err
+        }
+    }
+    m.conn = conn
+    return nil
+}
+
+/* Releases the connections held for SQL store. Data is already durable
+ * in the server so nothing needs to be dumped into the snapshot file.
+ */
+func (m *mysqlStore) Close(snapshot string) error {
+    if m.conn == nil {
+        return nil
+    }
+    err := m.conn.Close()
+    m.conn = nil
+    return err
+}
+
+/* Checks Timestamp of the stored row, and profile of driver in registry mode,
+ * and writes the update in one transaction, as other servers sharing the
+ * tables may be updating the same driver
+ */
+func (m *mysqlStore) Upsert(d DriverStore) error {
+    tx, err := m.conn.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()         // no-op once committed
+
+    if m.registry {
+        var active bool
+        err = tx.QueryRow(sqlProfileActive, int64(d.Id)).Scan(&active)
+        if err == nil && !active {
+            return errDriverInactive
+        }
+        if err != nil && err != sql.ErrNoRows {
+            return err
+        }
+    }
+
+    var old DriverStore
+    err = tx.QueryRow(sqlLockDriver, int64(d.Id)).Scan(&old.Timestamp, &old.Status, &old.Removed, &old.RemovedAt)
+    if err == nil && isStaleUpdate(d.Timestamp, d.ReceivedAt, old) {
+        return errStaleUpdate
+    }
+    var conflict error
+    if err == sql.ErrNoRows {
+        old.Status = STATUS_AVAILABLE
+    } else if err != nil {
+        return err
+    } else if d.Status != "" && !canTransition(old.Status, d.Status) {
+        d.Status, conflict = "", errBadTransition
+    }
+    if d.Status == "" {
+        d.Status = old.Status
+    }
+    if _, err = tx.Exec(sqlUpsertDriver, int64(d.Id), d.Latitude, d.Longitude, d.AccOrDist,
+                            d.ReceivedAt, d.Timestamp, string(d.Status), d.Removed, d.RemovedAt); err != nil {
+        return err
+    }
+    if err = tx.Commit(); err != nil {
+        return err
+    }
+    return conflict
+}
+
+func (m *mysqlStore) RemoveLocation(id float64, at int64) (bool, error) {
+    res, err := m.conn.Exec(sqlRemoveLocation, at, int64(id))
+    if err != nil {
+        return false, err
+    }
+    n, err := res.RowsAffected()
+    return n > 0, err
+}
+
+func (m *mysqlStore) SetStatus(id float64, status DriverStatus) (DriverStatus, error) {
+    tx, err := m.conn.Begin()
+    if err != nil {
+        return "", err
+    }
+    defer tx.Rollback()
+
+    var ts, removedAt int64
+    var prev DriverStatus
+    var removed bool
+    err = tx.QueryRow(sqlLockDriver, int64(id)).Scan(&ts, &prev, &removed, &removedAt)
+    if err == sql.ErrNoRows || (err == nil && removed) {
+        return "", errDriverNotFound
+    }
+    if err != nil {
+        return "", err
+    }
+    if !canTransition(prev, status) {
+        return prev, errBadTransition
+    }
+    if _, err = tx.Exec(sqlSetDriverStatus, string(status), int64(id)); err != nil {
+        return prev, err
+    }
+    return prev, tx.Commit()
+}
+
+func (m *mysqlStore) SetVehicle(v Vehicle) error {
+    _, err := m.conn.Exec(sqlUpsertVehicle, int64(v.Id), string(v.Class), v.Seats, v.Features)
+    return err
+}
+
+func (m *mysqlStore) CreateProfile(p DriverProfile) error {
+    res, err := m.conn.Exec(sqlInsertProfile, int64(p.Id), p.Name, p.Phone, p.Active, p.CreatedAt, p.UpdatedAt)
+    if err != nil {
+        return err
+    }
+    if n, err := res.RowsAffected(); err != nil {
+        return err
+    } else if n == 0 {
+        return errDriverExists
+    }
+    return nil
+}
+
+/* Rows affected by an UPDATE do not tell a missing row from an unchanged one,
+ * so the row is looked up first in the same transaction
+ */
+func (m *mysqlStore) UpdateProfile(p DriverProfile) error {
+    tx, err := m.conn.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    var id int64
+    err = tx.QueryRow(sqlLockProfile, int64(p.Id)).Scan(&id)
+    if err == sql.ErrNoRows {
+        return errDriverNotFound
+    }
+    if err != nil {
+        return err
+    }
+    if _, err = tx.Exec(sqlUpdateProfile, p.Name, p.Phone, p.Active, p.UpdatedAt, int64(p.Id)); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+func (m *mysqlStore) GetProfile(id float64) (DriverProfile, bool, error) {
+    var p DriverProfile
+    err := m.conn.QueryRow(sqlProfileById, int64(id)).Scan(&p.Id, &p.Name, &p.Phone, &p.Active,
+                                                            &p.CreatedAt, &p.UpdatedAt)
+    if err == sql.ErrNoRows {
+        return p, false, nil
+    }
+    if err != nil {
+        return p, false, err
+    }
+    return p, true, nil
+}
+
+func (m *mysqlStore) Get(id float64) (DriverStore, bool, error) {
+    d, err := scanDriver(m.conn.QueryRow(sqlDriverById, int64(id)))
+    if err == sql.ErrNoRows {
+        return d, false, nil
+    }
+    if err != nil {
+        return d, false, err
+    }
+    return d, true, nil
+}
+
+func (m *mysqlStore) GetState(id float64) (DriverStore, bool, error) {
+    d := DriverStore{Id: id}
+    err := m.conn.QueryRow(sqlDriverState, int64(id)).Scan(&d.Timestamp, &d.Status, &d.Removed, &d.RemovedAt)
+    if err == sql.ErrNoRows {
+        return d, false, nil
+    }
+    if err != nil {
+        return d, false, err
+    }
+    return d, true, nil
+}
+
+/* Extracts nearest drivers for given coordinates.
+ * Only the rows inside the bounding box returned by getRangeOfCoordinates() are
+ * fetched, leaving out the ones not updated since v["since"], not in status mask v["status"] or whose vehicle
+ * does not match the filters. Each of them within the search circle is offered to a nearestCollector which
+ * keeps the "lim" nearest.
+ */
+func (m *mysqlStore) Nearest(v Values) ([]DriverStore, error) {
+    la := v["lat"]
+    lo := v["lon"]
+    ra := v["rad"]
+    c := newNearestCollector((int)(v["lim"]))
+
+    minLat, maxLat, minLon, maxLon := getRangeOfCoordinates(v)
+    class, seats, features := int64(v["class"]), int64(v["seats"]), int64(v["features"])
+    rows, err := m.conn.Query(sqlDriversInBox, minLat, maxLat, minLon, maxLon, int64(v["since"]),
+                                statusNames(v["status"]), class, classNames(v["class"]), seats, seats,
+                                features, features, features)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    scanned := 0
+    defer func() { atomic.AddInt64(&nearestScanned, int64(scanned)) }()
+    for rows.Next() {
+        d, err := scanDriver(rows)
+        if err != nil {
+            return nil, err
+        }
+        scanned++
+        dis := Distance(la, lo, d.Latitude, d.Longitude)
+        if dis <= ra {
+            d.AccOrDist = dis        // reusing this field to return distance calculated
+            c.offer(d)
+        }
+    }
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    return c.sorted(), nil
+}
+
+func (m *mysqlStore) Evict(before int64) (int, error) {
+    res, err := m.conn.Exec(sqlEvictDrivers, before)
+    if err != nil {
+        return 0, err
+    }
+    n, err := res.RowsAffected()
+    return int(n), err
+}
+
+func (m *mysqlStore) Count() (int, error) {
+    var n int
+    err := m.conn.QueryRow(sqlCountDrivers).Scan(&n)
+    return n, err
+}
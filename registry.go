@@ -0,0 +1,191 @@
+package main
+
+/*
+ * Registry of drivers. Drivers are onboarded with a profile and offboarded
+ * by deactivating it, which keeps the profile for records -
+ *      POST   /drivers/{id}/profile    registers a new driver
+ *      GET    /drivers/{id}/profile    reads the profile
+ *      PUT    /drivers/{id}/profile    updates it; can also activate again
+ *      DELETE /drivers/{id}/profile    deactivates the driver and takes it off
+ *                                      searches right away
+ *
+ * With driver_id_mode "registry", updates from drivers not registered or
+ * deactivated get 404. The legacy "range" mode accepts any id between
+ * min_driver_id and max_driver_id instead, without looking at the registry.
+ */
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+/* Returned by Store.CreateProfile for an id already registered */
+var errDriverExists = errors.New("driver already registered")
+
+/* Returned by Store.Upsert for an update of a deactivated driver, which may
+ * have been queued before deactivating */
+var errDriverInactive = errors.New("driver is deactivated")
+
+/* Phone numbers accepted in profiles */
+var rPhone = regexp.MustCompile(`^\+?[0-9][0-9 -]{5,18}$`)
+
+const maxProfileName = 100
+
+/* Tells if driver id can send updates, as per cfg.DriverIdMode
+ * Returns the error message and HTTP error code if it can not, as validateParams
+ */
+func (a *App) checkDriver(r *http.Request, id float64) (string, int) {
+    if a.cfg.DriverIdMode == DRIVER_IDS_RANGE {
+        if id < float64(a.cfg.MinDriverId) || id > float64(a.cfg.MaxDriverId) {
+            return "DriverID is invalid", 404
+        }
+        return "", 200
+    }
+
+    p, found, err := db.GetProfile(id)
+    if err != nil {
+        logCtx(r.Context(), LOG_ERROR, "Error getting driver profile - %v", err)
+        return "Internal Server Error", http.StatusInternalServerError
+    }
+    if !found {
+        return "Driver is not registered", 404
+    }
+    if !p.Active {
+        return "Driver is deactivated", 404
+    }
+    return "", 200
+}
+
+/* Validator for '/drivers/{id}/profile' requests
+ * Profiles carry strings, which Values can not hold, so this is not reached
+ * through validateParams. Body is read only for POST and PUT.
+ * Returns :
+ *      float64 - driver id
+ *      DriverProfileUpdate - decoded body
+ *      string - contains the error message in case of validation failure
+ *      int - HTTP error code
+ */
+func validateProfileParams(r *http.Request) (float64, DriverProfileUpdate, string, int) {
+    var t DriverProfileUpdate
+    switch r.Method {
+        case "POST", "PUT", "GET", "DELETE":
+        default:
+            return 0, t, "Method not allowed for requested page", 405
+    }
+
+    uriSegments := strings.Split(r.URL.Path, "/")
+    driverId, err := strconv.ParseUint(uriSegments[2], 10, 64)
+    if err != nil || driverId < 1 {
+        return 0, t, "Invalid driverId", 400
+    }
+    if r.Method == "GET" || r.Method == "DELETE" {
+        return float64(driverId), t, "", 200
+    }
+
+    if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+        logCtx(r.Context(), LOG_DEBUG, "Bad request body - %v", err)
+        return 0, t, "Request Body format not valid", 422
+    }
+    defer r.Body.Close()
+
+    t.Name = strings.TrimSpace(t.Name)
+    if t.Name == "" || len(t.Name) > maxProfileName {
+        return 0, t, "Name should have 1 to " + strconv.Itoa(maxProfileName) + " characters", 422
+    }
+    if t.Phone != "" && !rPhone.MatchString(t.Phone) {
+        return 0, t, "Phone should have 6 to 19 digits, spaces or '-', optionally after '+'", 422
+    }
+    if r.Method == "POST" && t.Active != nil {
+        return 0, t, "Active can not be set while registering", 422
+    }
+    return float64(driverId), t, "", 200
+}
+
+/* Http Handler for '/drivers/{id}/profile' requests
+ * Inputs :
+ *      w - writer for response
+ *      r - HTTP request object
+ * Returns :
+ *      None
+ */
+func (a *App) driverProfile(w http.ResponseWriter, r *http.Request) {
+
+    id, t, errStr, errCode := validateProfileParams(r)
+    if len(errStr) > 0 {
+        setHttpErrorWithJson(w, errStr, errCode)
+        return
+    }
+
+    now := nowMillis()
+    var p DriverProfile
+    var err error
+    switch r.Method {
+        case "POST":
+            p = DriverProfile{Id: id, Name: t.Name, Phone: t.Phone, Active: true, CreatedAt: now, UpdatedAt: now}
+            if err = db.CreateProfile(p); err == nil {
+                logChange(r.Context(), WAL_PROFILE, p)
+            }
+
+        case "GET":
+            var found bool
+            if p, found, err = db.GetProfile(id); err == nil && !found {
+                err = errDriverNotFound
+            }
+
+        case "PUT", "DELETE":
+            var found bool
+            if p, found, err = db.GetProfile(id); err == nil && !found {
+                err = errDriverNotFound
+            }
+            if err != nil {
+                break
+            }
+            if r.Method == "PUT" {
+                p.Name, p.Phone = t.Name, t.Phone
+                if t.Active != nil {
+                    p.Active = *t.Active
+                }
+            } else {
+                p.Active = false
+            }
+            p.UpdatedAt = now
+            if err = db.UpdateProfile(p); err != nil {
+                break
+            }
+            logChange(r.Context(), WAL_PROFILE, p)
+            if !p.Active {
+                res, errStr, errCode := a.applyChange(w, r, WAL_REMOVE, DriverStore{Id: id, ReceivedAt: now})
+                if len(errStr) > 0 {
+                    setHttpErrorWithJson(w, errStr, errCode)
+                    return
+                }
+                err = res.err
+            }
+    }
+
+    switch err {
+        case nil:
+        case errDriverExists:
+            setHttpErrorWithJson(w, "Driver is already registered", http.StatusConflict)
+            return
+        case errDriverNotFound:
+            setHttpErrorWithJson(w, "Driver is not registered", http.StatusNotFound)
+            return
+        default:
+            logCtx(r.Context(), LOG_ERROR, "Error in driver profile - %v", err)
+            setHttpErrorWithJson(w, "Internal Server Error", http.StatusInternalServerError)
+            return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    if r.Method == "POST" {
+        w.WriteHeader(http.StatusCreated)
+    }
+    if err := json.NewEncoder(w).Encode(p); err != nil {
+        logCtx(r.Context(), LOG_ERROR, "Error: %s", err)
+    }
+}
@@ -7,11 +7,29 @@ package main
 import (
     "net/http"
     "regexp"
+    "time"
 )
 
 /* Regexes for acceptable endpoints. Optionally allows the trailing '/' */
 var rGetDriv = regexp.MustCompile(`^/drivers$(/?)$`)                // GET /drivers
-var rPutDriv = regexp.MustCompile(`^/drivers/\d+/location(/?)$`)    // PUT /drivers/{id}/location
+var rBatch   = regexp.MustCompile(`^/drivers/locations(/?)$`)       // POST /drivers/locations
+var rGetOne  = regexp.MustCompile(`^/drivers/\d+(/?)$`)             // GET /drivers/{id}
+var rPutDriv = regexp.MustCompile(`^/drivers/\d+/location(/?)$`)    // PUT, DELETE /drivers/{id}/location
+var rPutStat = regexp.MustCompile(`^/drivers/\d+/status(/?)$`)      // PUT /drivers/{id}/status
+var rPutVeh  = regexp.MustCompile(`^/drivers/\d+/vehicle(/?)$`)     // PUT /drivers/{id}/vehicle
+var rTrail   = regexp.MustCompile(`^/drivers/\d+/trail(/?)$`)       // GET /drivers/{id}/trail
+var rProfile = regexp.MustCompile(`^/drivers/\d+/profile(/?)$`)     // POST, GET, PUT, DELETE /drivers/{id}/profile
+var rMetrics = regexp.MustCompile(`^/metrics(/?)$`)                 // GET /metrics
+var rHealthz = regexp.MustCompile(`^/healthz(/?)$`)                 // GET /healthz
+var rReadyz  = regexp.MustCompile(`^/readyz(/?)$`)                  // GET /readyz
+var rStatus  = regexp.MustCompile(`^/status(/?)$`)                  // GET /status
+
+/* Builds the App for given config, whose route() is to be registered
+ * with HTTP server
+ */
+func newApp(cfg *Config, dispatcher *Dispatcher) *App {
+    return &App{cfg: cfg, dispatcher: dispatcher, started: time.Now()}
+}
 
 /* Routes all acceptable endpoints to their repective handlers
  * Inputs :
@@ -20,15 +38,82 @@ var rPutDriv = regexp.MustCompile(`^/drivers/\d+/location(/?)$`)    // PUT /driv
  * Returns :
  *      None
  */      
-func route(w http.ResponseWriter, r *http.Request) {
+func (a *App) route(w http.ResponseWriter, r *http.Request) {
     switch {
+        case rPutDriv.MatchString(r.URL.Path) && r.Method == "DELETE":
+                a.deleteDriverLocation(w, r)
+                return
         case rPutDriv.MatchString(r.URL.Path):
-                putDriver(w, r)
+                a.putDriver(w, r)
+                return
+        case rBatch.MatchString(r.URL.Path):
+                a.postDriverLocations(w, r)
+                return
+        case rGetOne.MatchString(r.URL.Path):
+                a.getDriver(w, r)
+                return
+        case rPutStat.MatchString(r.URL.Path):
+                a.putDriverStatus(w, r)
+                return
+        case rPutVeh.MatchString(r.URL.Path):
+                a.putDriverVehicle(w, r)
+                return
+        case rTrail.MatchString(r.URL.Path):
+                a.getDriverTrail(w, r)
+                return
+        case rProfile.MatchString(r.URL.Path):
+                a.driverProfile(w, r)
                 return
         case rGetDriv.MatchString(r.URL.Path):
-                getDrivers(w, r)
+                a.getDrivers(w, r)
+                return
+        case rMetrics.MatchString(r.URL.Path):
+                a.metrics(w, r)
+                return
+        case rHealthz.MatchString(r.URL.Path):
+                a.healthz(w, r)
+                return
+        case rReadyz.MatchString(r.URL.Path):
+                a.readyz(w, r)
+                return
+        case rStatus.MatchString(r.URL.Path):
+                a.status(w, r)
                 return
         default:   
                 http.Error(w, "Bad Request - Resource Unknown!", 404)
     }
 }
+
+/* Returns the endpoint matched by request as its path template, used as label
+ * of metrics so that every driver id does not make a series of its own
+ */
+func routeName(r *http.Request) string {
+    switch {
+        case rPutDriv.MatchString(r.URL.Path):
+                return "/drivers/{id}/location"
+        case rPutStat.MatchString(r.URL.Path):
+                return "/drivers/{id}/status"
+        case rPutVeh.MatchString(r.URL.Path):
+                return "/drivers/{id}/vehicle"
+        case rTrail.MatchString(r.URL.Path):
+                return "/drivers/{id}/trail"
+        case rProfile.MatchString(r.URL.Path):
+                return "/drivers/{id}/profile"
+        case rBatch.MatchString(r.URL.Path):
+                return "/drivers/locations"
+        case rGetOne.MatchString(r.URL.Path):
+                return "/drivers/{id}"
+        case rGetDriv.MatchString(r.URL.Path):
+                return "/drivers"
+        case rMetrics.MatchString(r.URL.Path):
+                return "/metrics"
+        case rHealthz.MatchString(r.URL.Path):
+                return "/healthz"
+        case rReadyz.MatchString(r.URL.Path):
+                return "/readyz"
+        case rStatus.MatchString(r.URL.Path):
+                return "/status"
+        default:
+                return "unknown"
+    }
+}
@@ -0,0 +1,263 @@
+package main
+
+/*
+ * Snapshots of stores that keep driver details in memory, so that
+ * last populated values survive a restart of the application.
+ *
+ * File format is newline delimited -
+ *      DRIVERS-SNAPSHOT 3                  header with format version
+ *      {"id":12,"latitude":...}            one JSON encoded DriverStore per line
+ *      ...
+ *      vehicle {"id":12,"class":...}       one JSON encoded Vehicle per line
+ *      ...
+ *      profile {"id":12,"name":...}        one JSON encoded DriverProfile per line
+ *      ...
+ *      END <count> <crc32>                 trailer with count of all records and
+ *                                          IEEE crc32 (hex) of all record lines
+ * Files of older versions are read as well; version 1 has only the drivers
+ * and version 2 no profiles.
+ * A file without trailer is taken as truncated and one whose count or
+ * checksum does not match as corrupt; both are rejected while loading.
+ *
+ * Files are written into a temporary file first which is renamed over
+ * the old one only after being synced, so a crash while writing never
+ * leaves a partial snapshot behind.
+ */
+
+import (
+    "bufio"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+)
+
+const snapshotHeader = "DRIVERS-SNAPSHOT 3"
+const snapshotHeaderV1 = "DRIVERS-SNAPSHOT 1"
+const snapshotHeaderV2 = "DRIVERS-SNAPSHOT 2"
+
+/* Prefixes of lines holding a vehicle or a profile */
+const snapshotVehicle = "vehicle "
+const snapshotProfile = "profile "
+
+var errCorruptSnapshot = errors.New("snapshot is corrupt or truncated")
+
+/* Implemented by stores that need snapshots to not lose their data
+ */
+type snapshotStore interface {
+    Store
+
+    /* Returns a copy of all drivers, vehicles and profiles in store */
+    Snapshot() snapshotData
+
+    /* Puts back the records read from a snapshot */
+    Restore(data snapshotData) error
+}
+
+/* Records held in a snapshot */
+type snapshotData struct {
+    drivers     []DriverStore
+    vehicles    []Vehicle
+    profiles    []DriverProfile
+}
+
+/* Count of all records in data */
+func (data snapshotData) count() int {
+    return len(data.drivers) + len(data.vehicles) + len(data.profiles)
+}
+
+/* Serialises writers of snapshots, like periodic one and the one at shutdown */
+var snapshotMu sync.Mutex
+
+/* Atomically replaces the file at path with a snapshot of given data
+ */
+func writeSnapshot(path string, data snapshotData) error {
+    snapshotMu.Lock()
+    defer snapshotMu.Unlock()
+
+    tmp, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())         // no-op once renamed
+
+    w := bufio.NewWriter(tmp)
+    crc := crc32.NewIEEE()
+    fmt.Fprintln(w, snapshotHeader)
+    record := func(prefix string, r interface{}) error {
+        b, err := json.Marshal(r)
+        if err != nil {
+            return err
+        }
+        b = append([]byte(prefix), append(b, '\n')...)
+        crc.Write(b)
+        w.Write(b)
+        return nil
+    }
+    for _, d := range data.drivers {
+        if err := record("", d); err != nil {
+            tmp.Close()
+            return err
+        }
+    }
+    for _, v := range data.vehicles {
+        if err := record(snapshotVehicle, v); err != nil {
+            tmp.Close()
+            return err
+        }
+    }
+    for _, p := range data.profiles {
+        if err := record(snapshotProfile, p); err != nil {
+            tmp.Close()
+            return err
+        }
+    }
+    fmt.Fprintf(w, "END %d %08x\n", data.count(), crc.Sum32())
+
+    if err = w.Flush(); err == nil {
+        err = tmp.Sync()
+    }
+    if cerr := tmp.Close(); err == nil {
+        err = cerr
+    }
+    if err != nil {
+        return err
+    }
+    if err = os.Rename(tmp.Name(), path); err != nil {
+        return err
+    }
+
+    /* make the rename itself durable */
+    if dir, err := os.Open(filepath.Dir(path)); err == nil {
+        dir.Sync()
+        dir.Close()
+    }
+    return nil
+}
+
+/* Reads back the records from snapshot at path
+ * Returns errCorruptSnapshot if file is not complete and intact
+ */
+func readSnapshot(path string) (snapshotData, error) {
+    var data snapshotData
+    file, err := os.Open(path)
+    if err != nil {
+        return data, err
+    }
+    defer file.Close()
+
+    sc := bufio.NewScanner(file)
+    if !sc.Scan() || (sc.Text() != snapshotHeader && sc.Text() != snapshotHeaderV1 && sc.Text() != snapshotHeaderV2) {
+        return data, errCorruptSnapshot
+    }
+
+    crc := crc32.NewIEEE()
+    for sc.Scan() {
+        line := sc.Bytes()
+        var err error
+        switch {
+            case len(line) > 0 && line[0] == '{':
+                var d DriverStore
+                err = json.Unmarshal(line, &d)
+                data.drivers = append(data.drivers, d)
+
+            case strings.HasPrefix(string(line), snapshotVehicle):
+                var v Vehicle
+                err = json.Unmarshal(line[len(snapshotVehicle):], &v)
+                data.vehicles = append(data.vehicles, v)
+
+            case strings.HasPrefix(string(line), snapshotProfile):
+                var p DriverProfile
+                err = json.Unmarshal(line[len(snapshotProfile):], &p)
+                data.profiles = append(data.profiles, p)
+
+            default:
+                var count int
+                var sum uint32
+                if _, err := fmt.Sscanf(string(line), "END %d %x", &count, &sum); err != nil {
+                    return snapshotData{}, errCorruptSnapshot
+                }
+                if count != data.count() || sum != crc.Sum32() || sc.Scan() {
+                    return snapshotData{}, errCorruptSnapshot
+                }
+                return data, nil
+        }
+        if err != nil {
+            return snapshotData{}, errCorruptSnapshot
+        }
+        crc.Write(line)
+        crc.Write([]byte{'\n'})
+    }
+    if err := sc.Err(); err != nil {
+        return snapshotData{}, err
+    }
+    return snapshotData{}, errCorruptSnapshot         // trailer never came
+}
+
+/* Writes snapshot of the store in use, if it needs one
+ */
+func saveSnapshot(path string) error {
+    s, ok := db.(snapshotStore)
+    if !ok {
+        return nil
+    }
+    return writeSnapshot(path, s.Snapshot())
+}
+
+/* Loads the snapshot at path into the store in use, if it needs one.
+ * A missing file is not an error as there is nothing to load on first start.
+ */
+func loadSnapshot(path string) error {
+    s, ok := db.(snapshotStore)
+    if !ok {
+        return nil
+    }
+    data, err := readSnapshot(path)
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return fmt.Errorf("loading snapshot %v - %v", path, err)
+    }
+    logInfo("Loaded %v drivers, %v vehicles and %v profiles from snapshot %v", len(data.drivers),
+                len(data.vehicles), len(data.profiles), path)
+    return s.Restore(data)
+}
+
+/* Held while checkpointing, so that shutdown does not close the store or
+ * write-ahead log under a checkpoint in progress */
+var checkpointMu sync.Mutex
+
+/* Saves snapshot to path, compacting the write-ahead log into it if one is in use
+ */
+func checkpoint(path string) error {
+    checkpointMu.Lock()
+    defer checkpointMu.Unlock()
+    if wal != nil {
+        return wal.Compact(path)
+    }
+    return saveSnapshot(path)
+}
+
+/* Checkpoints to path every interval till stop is closed;
+ * meant to be run as a go routine
+ */
+func runSnapshots(path string, interval time.Duration, stop <-chan bool) {
+    tick := time.NewTicker(interval)
+    defer tick.Stop()
+    for {
+        select {
+        case <-tick.C:
+            if err := checkpoint(path); err != nil {
+                logError("Error in saving snapshot to %v - %v", path, err)
+            }
+        case <-stop:
+            return
+        }
+    }
+}
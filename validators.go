@@ -5,11 +5,14 @@ package main
  */
 
 import (
+    "bufio"
+    "errors"
+    "io"
+    "math"
     "net/http"
     "strconv"
     "strings"
     "encoding/json"
-    "log"
 )
 
 
@@ -17,6 +20,7 @@ import (
  * Inputs :
  *      r - Htpt request object
  *      api - represents called request
+ *      cfg - config giving valid ranges and defaults
  * Returns : 
  *      url.Values - map[string][]string containing query params as keys
  *                   and their corresponding values in a string array
@@ -27,13 +31,28 @@ import (
  * associated with that param. If more params are present or the intended
  * params carry multiple values, we ignore them in this implementation
  */
-func validateParams(r *http.Request, api DrivApis) (Values, string, int)  {
+func validateParams(r *http.Request, api DrivApis, cfg *Config) (Values, string, int)  {
     switch api {
         case GetDrivers:
-            return validateGetDriverParams(r)
+            return validateGetDriverParams(r, cfg)
             
         case PutDriver:
-            return validatePutDriverParams(r)
+            return validatePutDriverParams(r, cfg)
+
+        case PutStatus:
+            return validatePutStatusParams(r, cfg)
+
+        case PutVehicle:
+            return validatePutVehicleParams(r, cfg)
+
+        case GetDriver:
+            return validateDriverParams(r, "GET")
+
+        case DelDriver:
+            return validateDriverParams(r, "DELETE")
+
+        case GetTrail:
+            return validateGetTrailParams(r, cfg)
 
         default:
             return nil, "api not implemented", 404
@@ -41,14 +60,16 @@ func validateParams(r *http.Request, api DrivApis) (Values, string, int)  {
 }
 
 
-/* Validator for 'PUT /driver'
- * Details as specified in validateParams
+/* Extracts driver id from path of '/drivers/{id}/...' requests, allowing only
+ * given method
+ * Returns the id, or error message and HTTP error code as validateParams.
+ * Whether the driver can send updates is checked by handlers, see checkDriver()
  */
-func validatePutDriverParams(r *http.Request) (Values, string, int)  {
+func validateDriverIdInPath(r *http.Request, method string) (uint64, string, int) {
 
-    /* allow only PUT method for this resource */
-    if r.Method != "PUT" {
-        return nil, "Method not allowed for requested page", 405
+    /* allow only given method for this resource */
+    if r.Method != method {
+        return 0, "Method not allowed for requested page", 405
     }
 
     /* Get parameters for extracting Driver ID */
@@ -56,22 +77,51 @@ func validatePutDriverParams(r *http.Request) (Values, string, int)  {
 
     driverId, err := strconv.ParseUint(uriSegments[2], 10, 64)       
     if err != nil {
-        return nil, "Invalid driverId type", 400
+        return 0, "Invalid driverId type", 400
+    }
+    return driverId, "", 200
+}
+
+/* Validator for 'PUT /driver'
+ * Details as specified in validateParams
+ * Optional status in body is returned as its bit in "status", see statusBit(),
+ * and optional timestamp in "ts"
+ */
+func validatePutDriverParams(r *http.Request, cfg *Config) (Values, string, int)  {
+
+    driverId, errStr, errCode := validateDriverIdInPath(r, "PUT")
+    if len(errStr) > 0 {
+        return nil, errStr, errCode
     }
 
     /* Decode the provided fields for Driver */
     decoder := json.NewDecoder(r.Body)
     var t DriverUpdates   
-    err = decoder.Decode(&t)
+    err := decoder.Decode(&t)
     if err != nil {
-        log.Println(err)
+        logCtx(r.Context(), LOG_DEBUG, "Bad request body - %v", err)
         return nil, "Request Body format not valid", 422
     }
     defer r.Body.Close()
 
-    if driverId < MIN_DRIVER_ID || driverId > MAX_DRIVER_ID {
-        return nil, "DriverID is invalid", 404
-    } 
+    vs, errStr, errCode := validateDriverUpdates(t, cfg, nowMillis())
+    if len(errStr) > 0 {
+        return nil, errStr, errCode
+    }
+    vs.Add("id", float64(driverId))
+
+    return vs, "", 200      //200 is just a placeholder for our function signatures
+}
+
+/* Checks fields of a location update, sent alone by 'PUT /drivers/{id}/location'
+ * or in a batch by 'POST /drivers/locations'. A device timestamp should not be
+ * ahead of server time now by more than MaxClockSkewMs, nor older than
+ * DriverTTLSec as the driver would be evicted right away.
+ * Returns them in Values without "id", timestamp in "ts" only if given, or
+ * error message and HTTP error code as validateParams
+ */
+func validateDriverUpdates(t DriverUpdates, cfg *Config, now int64) (Values, string, int) {
+
     if t.Latitude > 90 || t.Latitude < -90 {
         return nil, "Latitude should be between +/- 90", 422
     }
@@ -81,22 +131,278 @@ func validatePutDriverParams(r *http.Request) (Values, string, int)  {
     if t.Accuracy > 1.0 || t.Accuracy < 0.0 {
         return nil, "Accuracy should be between 0 to 1.0", 422
     }
+    status, ok := parseDriverStatus(t.Status)
+    if t.Status != "" && !ok {
+        return nil, "Status should be one of " + statusNames(0), 422
+    }
+
+    if t.Timestamp > now + int64(cfg.MaxClockSkewMs) {
+        return nil, "Timestamp should not be ahead of server time", 422
+    } else if t.Timestamp != 0 && t.Timestamp < now - int64(cfg.DriverTTLSec) * 1000 {
+        return nil, "Timestamp older than " + strconv.Itoa(cfg.DriverTTLSec) + " sec", 422
+    }
 
     vs := make(Values)
-    vs.Add("id", float64(driverId))
     vs.Add("lat", t.Latitude)
     vs.Add("lon", t.Longitude)
     vs.Add("acc", t.Accuracy)
+    vs.Add("status", statusBit(status))
+    if t.Timestamp != 0 {
+        vs.Add("ts", float64(t.Timestamp))
+    }
+    return vs, "", 200
+}
 
-    return vs, "", 200      //200 is just a placeholder for our function signatures
+
+
+/* Validator for 'POST /drivers/locations'
+ * Body is a JSON array of DriverBatchItem, or a stream of them one per line
+ * (NDJSON). Only the framing is checked here, items are left raw for
+ * validateBatchItem so that a bad one rejects only itself. Reading stops at
+ * cfg.MaxBatchBytes of body, closing the connection after the response.
+ * Returns the items, or error message and HTTP error code as validateParams
+ */
+func validateBatchParams(w http.ResponseWriter, r *http.Request, cfg *Config) ([]json.RawMessage, string, int) {
+
+    /* allow only POST method for this resource */
+    if r.Method != "POST" {
+        return nil, "Method not allowed for requested page", 405
+    }
+    r.Body = http.MaxBytesReader(w, r.Body, int64(cfg.MaxBatchBytes))
+    defer r.Body.Close()
+
+    badBody := func(err error) ([]json.RawMessage, string, int) {
+        var tooLarge *http.MaxBytesError
+        if errors.As(err, &tooLarge) {
+            return nil, "Batch should have at most " + strconv.Itoa(cfg.MaxBatchBytes) + " bytes", 413
+        }
+        logCtx(r.Context(), LOG_DEBUG, "Bad request body - %v", err)
+        return nil, "Request Body format not valid", 422
+    }
+
+    br := bufio.NewReader(r.Body)
+    decoder := json.NewDecoder(br)
+    array := false
+    for {
+        b, err := br.Peek(1)
+        if err == io.EOF {
+            break                   // empty body, reported below
+        }
+        if err != nil {
+            return badBody(err)
+        }
+        if b[0] == ' ' || b[0] == '\t' || b[0] == '\r' || b[0] == '\n' {
+            br.ReadByte()
+            continue
+        }
+        if array = b[0] == '['; array {
+            decoder.Token()
+        }
+        break
+    }
+
+    var items []json.RawMessage
+    for {
+        if array && !decoder.More() {
+            if _, err := decoder.Token(); err != nil {
+                return badBody(err)
+            }
+            break
+        }
+        var item json.RawMessage
+        err := decoder.Decode(&item)
+        if err == io.EOF && !array {
+            break
+        }
+        if err != nil {
+            return badBody(err)
+        }
+        if len(items) == cfg.MaxBatchItems {
+            return nil, "Batch should have at most " + strconv.Itoa(cfg.MaxBatchItems) + " items", 413
+        }
+        items = append(items, item)
+    }
+    if len(items) == 0 {
+        return nil, "Batch has no items", 422
+    }
+    return items, "", 200
+}
+
+/* Checks an item of 'POST /drivers/locations' with the rules of
+ * validatePutDriverParams
+ * Returns Values as validatePutDriverParams, or error message and HTTP error
+ * code the item would have got as a PUT of its own, in which case Values
+ * still carry "id" once it is read
+ */
+func validateBatchItem(raw json.RawMessage, cfg *Config, now int64) (Values, string, int) {
+
+    var t DriverBatchItem
+    if err := json.Unmarshal(raw, &t); err != nil {
+        return nil, "Item format not valid", 422
+    }
+    if t.Id < 1 || t.Id != math.Trunc(t.Id) {
+        return nil, "Invalid driverId type", 400
+    }
+    vs := Values{"id": t.Id}
+
+    loc, errStr, errCode := validateDriverUpdates(t.DriverUpdates, cfg, now)
+    if len(errStr) > 0 {
+        return vs, errStr, errCode
+    }
+    for k, v := range loc {
+        vs.Add(k, v)
+    }
+    return vs, "", 200
 }
 
 
+/* Validator for 'GET /drivers/{id}' and 'DELETE /drivers/{id}/location',
+ * which carry nothing but the id
+ * Details as specified in validateParams
+ */
+func validateDriverParams(r *http.Request, method string) (Values, string, int)  {
+
+    driverId, errStr, errCode := validateDriverIdInPath(r, method)
+    if len(errStr) > 0 {
+        return nil, errStr, errCode
+    }
+
+    vs := make(Values)
+    vs.Add("id", float64(driverId))
+    return vs, "", 200
+}
+
+
+/* Validator for 'GET /drivers/{id}/trail'
+ * Details as specified in validateParams
+ * Optional "from" and "to" are unix ms, to defaulting to now and from to
+ * HistoryMaxAgeSec before to. Optional "format" is json or geojson, returned
+ * as 1 in "geojson" for the latter
+ */
+func validateGetTrailParams(r *http.Request, cfg *Config) (Values, string, int)  {
+
+    driverId, errStr, errCode := validateDriverIdInPath(r, "GET")
+    if len(errStr) > 0 {
+        return nil, errStr, errCode
+    }
+    vs := r.URL.Query()
+
+    to := nowMillis()
+    if v := vs.Get("to"); v != "" {
+        t, err := strconv.ParseInt(v, 10, 64)
+        if err != nil {
+            return nil, "Invalid to type", 400
+        }
+        to = t
+    }
+    from := to - int64(cfg.HistoryMaxAgeSec) * 1000
+    if v := vs.Get("from"); v != "" {
+        f, err := strconv.ParseInt(v, 10, 64)
+        if err != nil {
+            return nil, "Invalid from type", 400
+        } else if f > to {
+            return nil, "from should not be after to", 400
+        }
+        from = f
+    }
+
+    var geojson float64
+    switch vs.Get("format") {
+        case "", "json":
+        case "geojson":
+            geojson = 1
+        default:
+            return nil, "Invalid format, should be json or geojson", 400
+    }
+
+    vv := make(Values)
+    vv.Add("id", float64(driverId))
+    vv.Add("from", float64(from))
+    vv.Add("to", float64(to))
+    vv.Add("geojson", geojson)
+    return vv, "", 200
+}
+
+
+/* Validator for 'PUT /drivers/{id}/status'
+ * Details as specified in validateParams
+ * Status is returned as its bit in "status", see statusBit()
+ */
+func validatePutStatusParams(r *http.Request, cfg *Config) (Values, string, int)  {
+
+    driverId, errStr, errCode := validateDriverIdInPath(r, "PUT")
+    if len(errStr) > 0 {
+        return nil, errStr, errCode
+    }
+
+    var t DriverStatusUpdate
+    if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+        logCtx(r.Context(), LOG_DEBUG, "Bad request body - %v", err)
+        return nil, "Request Body format not valid", 422
+    }
+    defer r.Body.Close()
+
+    status, ok := parseDriverStatus(t.Status)
+    if !ok {
+        return nil, "Status should be one of " + statusNames(0), 422
+    }
+
+    vs := make(Values)
+    vs.Add("id", float64(driverId))
+    vs.Add("status", statusBit(status))
+    return vs, "", 200
+}
+
+
+/* Validator for 'PUT /drivers/{id}/vehicle'
+ * Details as specified in validateParams
+ * Class is returned as its bit in "class" and features as mask in "features"
+ */
+func validatePutVehicleParams(r *http.Request, cfg *Config) (Values, string, int)  {
+
+    driverId, errStr, errCode := validateDriverIdInPath(r, "PUT")
+    if len(errStr) > 0 {
+        return nil, errStr, errCode
+    }
+
+    var t DriverVehicle
+    if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+        logCtx(r.Context(), LOG_DEBUG, "Bad request body - %v", err)
+        return nil, "Request Body format not valid", 422
+    }
+    defer r.Body.Close()
+
+    class, ok := parseVehicleClass(t.Class)
+    if !ok {
+        return nil, "Class should be one of " + classNames(-1), 422
+    }
+    if t.Seats < 1 || t.Seats > MAX_VEHICLE_SEATS {
+        return nil, "Seats should be between 1 to " + strconv.Itoa(MAX_VEHICLE_SEATS), 422
+    }
+    features, ok := featureMask(t.Features)
+    if !ok {
+        return nil, "Features should be among " + strings.Join(vehicleFeatures, ","), 422
+    }
+
+    vs := make(Values)
+    vs.Add("id", float64(driverId))
+    vs.Add("class", float64(classBit(class)))
+    vs.Add("seats", float64(t.Seats))
+    vs.Add("features", float64(features))
+    return vs, "", 200
+}
+
 
 /* Validator for 'GET /drivers'
  * Details as specified in validateParams
+ * Optional "status" is a comma separated list of statuses to include, or "all";
+ * only available drivers are included otherwise. Returned as mask in "status"
+ * Optional vehicle filters, returned as described in vehicle.go -
+ *      "vehicle"   comma separated list of classes
+ *      "min_seats" least seats needed
+ *      "features"  comma separated list of features all needed
  */
-func validateGetDriverParams(r *http.Request) (Values, string, int) {
+func validateGetDriverParams(r *http.Request, cfg *Config) (Values, string, int) {
 
     /* allow only GET method for this resource */
     if r.Method != "GET" {
@@ -136,7 +442,7 @@ func validateGetDriverParams(r *http.Request) (Values, string, int) {
         if err != nil {
             return nil, "Invalid radius type", 400
         }
-        rad := r/(111000)      //convert into radians assuming specified radius is in meters
+        rad := r/(METERS_PER_DEGREE)      //convert into radians assuming specified radius is in meters
         if rad <= 0 || (lat-rad) < -90 || (lat+rad) > 90 {
             return nil, "Invalid radius value for specified latitude", 400
         } else if rad <= 0 || (lon-rad) < -180 || (lon+rad) > 180 {
@@ -144,29 +450,77 @@ func validateGetDriverParams(r *http.Request) (Values, string, int) {
         }
         ra = r
     } else {
-        ra = RADIUS
+        ra = cfg.Radius
     }
 
     if v := vs.Get("limit"); v != "" {
         lim, err := strconv.ParseUint(v, 10, 64)
         if err != nil {
             return nil, "Invalid limit type", 400
-        } else if lim < MIN_DRIVER_ID || lim > MAX_DRIVER_ID {
-            s := "Invalid limit value, min " + strconv.FormatUint(MIN_DRIVER_ID, 10) + ", max " +
-                    strconv.FormatUint(MAX_DRIVER_ID, 10)
+        } else if lim < 1 || lim > uint64(cfg.MaxDriverId) {
+            s := "Invalid limit value, min 1, max " + strconv.Itoa(cfg.MaxDriverId)
             return nil, s, 400
         }
         l = float64(lim)
     } else {
-        l = LIMIT
+        l = float64(cfg.Limit)
     } 
 
+    mask := statusBit(STATUS_AVAILABLE)
+    if v := vs.Get("status"); v == "all" {
+        mask = 0
+    } else if v != "" {
+        mask = 0
+        for _, name := range strings.Split(v, ",") {
+            s, ok := parseDriverStatus(strings.TrimSpace(name))
+            if !ok {
+                return nil, "Invalid status, should be all or list of " + statusNames(0), 400
+            }
+            mask = float64(int(mask) | int(statusBit(s)))
+        }
+    }
+
+    var class, seats, features float64
+    if v := vs.Get("vehicle"); v != "" {
+        for _, name := range strings.Split(v, ",") {
+            c, ok := parseVehicleClass(strings.TrimSpace(name))
+            if !ok {
+                return nil, "Invalid vehicle, should be list of " + classNames(-1), 400
+            }
+            class = float64(int(class) | classBit(c))
+        }
+    }
+    if v := vs.Get("min_seats"); v != "" {
+        n, err := strconv.ParseUint(v, 10, 64)
+        if err != nil {
+            return nil, "Invalid min_seats type", 400
+        } else if n < 1 || n > MAX_VEHICLE_SEATS {
+            return nil, "Invalid min_seats value, min 1, max " + strconv.Itoa(MAX_VEHICLE_SEATS), 400
+        }
+        seats = float64(n)
+    }
+    if v := vs.Get("features"); v != "" {
+        names := strings.Split(v, ",")
+        for i := range names {
+            names[i] = strings.TrimSpace(names[i])
+        }
+        mask, ok := featureMask(names)
+        if !ok {
+            return nil, "Invalid features, should be list of " + strings.Join(vehicleFeatures, ","), 400
+        }
+        features = float64(mask)
+    }
+
     /* All float64s */
     vv := make(Values)
     vv.Add("lat", lat)
     vv.Add("lon", lon)
     vv.Add("rad", ra)
     vv.Add("lim", l)
+    vv.Add("status", mask)
+    vv.Add("class", class)
+    vv.Add("seats", seats)
+    vv.Add("features", features)
 
     return vv, "", 200
 }
@@ -0,0 +1,132 @@
+package main
+
+/*
+ * Vehicles of drivers and the search filters on them.
+ * A driver registers the vehicle once through 'PUT /drivers/{id}/vehicle'
+ * and stores keep it apart from the location, so that it is not lost when
+ * the driver is evicted for not updating.
+ *
+ * Searches take the filters as float64s in Values -
+ *      "class"     bit mask of classes to include, 0 for any
+ *      "seats"     least seats needed, 0 for any
+ *      "features"  bit mask of features all needed, 0 for none
+ * A driver without a registered vehicle matches only when no filter is set.
+ */
+
+import (
+    "strings"
+)
+
+/* Every class, in order of their bits in a mask */
+var vehicleClasses = []VehicleClass{VEHICLE_HATCHBACK, VEHICLE_SEDAN, VEHICLE_XL, VEHICLE_BIKE}
+
+/* Accessibility and comfort features, in order of their bits in a mask */
+var vehicleFeatures = []string{"wheelchair", "child_seat", "pet_friendly"}
+
+/* Returns the class with given name; false if there is none
+ */
+func parseVehicleClass(name string) (VehicleClass, bool) {
+    for _, c := range vehicleClasses {
+        if string(c) == name {
+            return c, true
+        }
+    }
+    return "", false
+}
+
+/* Returns the bit of class c in a mask, 0 for an unknown one
+ */
+func classBit(c VehicleClass) int {
+    for i, vc := range vehicleClasses {
+        if vc == c {
+            return 1 << uint(i)
+        }
+    }
+    return 0
+}
+
+/* Returns the class whose bit is b
+ */
+func classOfBit(b float64) VehicleClass {
+    for _, c := range vehicleClasses {
+        if float64(classBit(c)) == b {
+            return c
+        }
+    }
+    return ""
+}
+
+/* Returns the classes in mask as comma separated names, for SQL FIND_IN_SET();
+ * empty for a mask of 0 and every class for -1
+ */
+func classNames(mask float64) string {
+    var names []string
+    for _, c := range vehicleClasses {
+        if classBit(c)&int(mask) != 0 {
+            names = append(names, string(c))
+        }
+    }
+    return strings.Join(names, ",")
+}
+
+/* Returns the mask of named features; false if any of them is unknown
+ */
+func featureMask(names []string) (int, bool) {
+    mask := 0
+    for _, name := range names {
+        found := false
+        for i, f := range vehicleFeatures {
+            if f == name {
+                mask |= 1 << uint(i)
+                found = true
+            }
+        }
+        if !found {
+            return 0, false
+        }
+    }
+    return mask, true
+}
+
+/* Returns the names of features in mask
+ */
+func featureNames(mask int) []string {
+    names := []string{}
+    for i, f := range vehicleFeatures {
+        if mask&(1<<uint(i)) != 0 {
+            names = append(names, f)
+        }
+    }
+    return names
+}
+
+/* Tells if v has any of the vehicle filters set
+ */
+func hasVehicleFilter(v Values) bool {
+    return v["class"] != 0 || v["seats"] != 0 || v["features"] != 0
+}
+
+/* Tells if vehicle veh, nil if not registered, passes the filters in v
+ */
+func vehicleMatches(veh *Vehicle, v Values) bool {
+    if !hasVehicleFilter(v) {
+        return true
+    }
+    if veh == nil {
+        return false
+    }
+    if v["class"] != 0 && classBit(veh.Class)&int(v["class"]) == 0 {
+        return false
+    }
+    need := int(v["features"])
+    return float64(veh.Seats) >= v["seats"] && veh.Features&need == need
+}
+
+/* Returns the vehicle as shown in responses, nil if not registered
+ */
+func vehicleResp(veh *Vehicle) *DriverVehicle {
+    if veh == nil {
+        return nil
+    }
+    return &DriverVehicle{Class: string(veh.Class), Seats: veh.Seats, Features: featureNames(veh.Features)}
+}
@@ -0,0 +1,394 @@
+package main
+
+/*
+ * Write-ahead log for driver location updates.
+ * PUT requests are responded before workers apply them to the store, so
+ * every update is appended here before being queued for the workers and
+ * a crash does not lose the queued ones.
+ * Changes of status and removals of location are queued the same way, behind
+ * the updates of the driver, so replay applies them in the order the workers
+ * did. Vehicles and profiles, applied right away by their requests, are
+ * appended once applied so that they are not lost either till next snapshot.
+ *
+ * Appends only go into a buffer; the buffer is flushed and fsync'ed every
+ * Config.WalSyncIntervalMs, which batches many updates into one fsync and bounds
+ * the updates lost in a crash to those received within that window. The fsync
+ * runs without holding up Appends, so requests do not wait on the disk.
+ *
+ * The log is kept in segment files (wal-<seq>.log) inside Config.WalDir with one
+ * record per line, the checksum being of rest of the line -
+ *      <crc32> {"id":12,"latitude":...}          location update
+ *      <crc32> <kind> {...}                      other change, kind being one of WAL_*
+ * On start, all segments are replayed into the store after loading the snapshot.
+ * Compaction starts a new segment, waits till the updates in older ones are
+ * applied, saves the snapshot and then deletes the older segments.
+ */
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "hash/crc32"
+    "os"
+    "path/filepath"
+    "sort"
+    "sync"
+    "time"
+)
+
+/* Log in use; nil when Config.WalDir is empty */
+var wal *writeAheadLog
+
+/* Kinds of records other than location updates, with what they hold */
+const (
+    WAL_VEHICLE = "vehicle"     // Vehicle registered by Store.SetVehicle
+    WAL_PROFILE = "profile"     // DriverProfile as created or updated
+    WAL_STATUS  = "status"      // Job with Id and Status for Store.SetStatus
+    WAL_REMOVE  = "remove"      // Job with Id, and ReceivedAt as time of removal, for Store.RemoveLocation
+)
+
+type walSegment struct {
+    seq     uint64
+    file    *os.File
+    w       *bufio.Writer
+    pending sync.WaitGroup      // records appended but not yet applied to store
+}
+
+type writeAheadLog struct {
+    mu      sync.Mutex          // guards cur and dirty, held by Append
+    syncMu  sync.Mutex          // held across fsync, so that a segment is not closed under it;
+                                // taken before mu when both are needed
+    dir     string
+    cur     *walSegment
+    dirty   bool
+}
+
+func walSegmentPath(dir string, seq uint64) string {
+    return filepath.Join(dir, fmt.Sprintf("wal-%06d.log", seq))
+}
+
+/* Returns sequence numbers of segments present in dir in ascending order
+ */
+func walSegments(dir string) ([]uint64, error) {
+    paths, err := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+    if err != nil {
+        return nil, err
+    }
+    var seqs []uint64
+    for _, p := range paths {
+        var seq uint64
+        if _, err := fmt.Sscanf(filepath.Base(p), "wal-%d.log", &seq); err == nil {
+            seqs = append(seqs, seq)
+        }
+    }
+    sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+    return seqs, nil
+}
+
+/* Opens the log in dir. Segments left by last run are replayed into the store
+ * in use and compacted into the snapshot at given path before a fresh segment
+ * is started.
+ */
+func openWAL(dir string, snapshot string) (*writeAheadLog, error) {
+    if err := os.MkdirAll(dir, 0700); err != nil {
+        return nil, err
+    }
+    seqs, err := walSegments(dir)
+    if err != nil {
+        return nil, err
+    }
+
+    /* records are in order of queueing, not of their Timestamp, so some
+     * may be older than what is already applied */
+    apply := func(kind string, rec []byte) error {
+        if err := applyWALRecord(kind, rec); err != nil && err != errStaleUpdate && err != errBadTransition &&
+                err != errDriverNotFound && err != errDriverInactive {
+            return err
+        }
+        return nil
+    }
+
+    var last uint64
+    if len(seqs) > 0 {
+        replayed := 0
+        for _, seq := range seqs {
+            n, err := replayWALSegment(walSegmentPath(dir, seq), apply)
+            if err != nil {
+                return nil, err
+            }
+            replayed += n
+        }
+        logInfo("Replayed %v records from write-ahead log %v", replayed, dir)
+        if err := saveSnapshot(snapshot); err != nil {
+            return nil, err
+        }
+        for _, seq := range seqs {
+            os.Remove(walSegmentPath(dir, seq))
+        }
+        last = seqs[len(seqs)-1]
+    }
+
+    l := &writeAheadLog{dir: dir}
+    if l.cur, err = l.newSegment(last + 1); err != nil {
+        return nil, err
+    }
+    return l, nil
+}
+
+func (l *writeAheadLog) newSegment(seq uint64) (*walSegment, error) {
+    f, err := os.OpenFile(walSegmentPath(l.dir, seq), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+    if err != nil {
+        return nil, err
+    }
+    return &walSegment{seq: seq, file: f, w: bufio.NewWriter(f)}, nil
+}
+
+/* Applies a record of given kind, empty for a location update, to the store
+ * in use. A change already in the store may be applied again, as the snapshot
+ * can be taken after it was applied but before it was appended
+ */
+func applyWALRecord(kind string, rec []byte) error {
+    switch kind {
+        case "", WAL_STATUS, WAL_REMOVE:
+            var d DriverStore
+            if err := json.Unmarshal(rec, &d); err != nil {
+                return err
+            }
+            return (Job{Payload: d, Kind: kind}).apply().err
+        case WAL_VEHICLE:
+            var v Vehicle
+            if err := json.Unmarshal(rec, &v); err != nil {
+                return err
+            }
+            return db.SetVehicle(v)
+        case WAL_PROFILE:
+            var p DriverProfile
+            if err := json.Unmarshal(rec, &p); err != nil {
+                return err
+            }
+            if err := db.CreateProfile(p); err != errDriverExists {
+                return err
+            }
+            return db.UpdateProfile(p)
+    }
+    return fmt.Errorf("unknown kind of record %q", kind)
+}
+
+/* Applies every intact record of the segment at path, giving apply its kind
+ * and JSON. A record that fails its checksum is a write torn by the crash, so
+ * rest of the segment is skipped.
+ * Returns the count of records applied.
+ */
+func replayWALSegment(path string, apply func(kind string, rec []byte) error) (int, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return 0, err
+    }
+    defer file.Close()
+
+    n := 0
+    sc := bufio.NewScanner(file)
+    for sc.Scan() {
+        var sum uint32
+        line := sc.Bytes()
+        if len(line) < 10 || line[8] != ' ' {
+            logWarn("Skipping rest of write-ahead log %v after %v records - bad record", path, n)
+            break
+        }
+        kind, rec := "", line[9:]
+        if i := bytes.IndexByte(rec, ' '); rec[0] != '{' && i > 0 {
+            kind, rec = string(rec[:i]), rec[i+1:]
+        }
+        if _, err := fmt.Sscanf(string(line[:8]), "%x", &sum); err != nil ||
+                sum != crc32.ChecksumIEEE(line[9:]) || !json.Valid(rec) {
+            logWarn("Skipping rest of write-ahead log %v after %v records - bad record", path, n)
+            break
+        }
+        if err := apply(kind, rec); err != nil {
+            return n, err
+        }
+        n++
+    }
+    return n, sc.Err()
+}
+
+/* Appends the queued job of given Kind to current segment. Returned segment
+ * must be told through Done() on its pending group once the job is applied
+ * to store.
+ */
+func (l *writeAheadLog) Append(kind string, d DriverStore) (*walSegment, error) {
+    rec, err := walRecord(kind, d)
+    if err != nil {
+        return nil, err
+    }
+
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if err := l.write(rec); err != nil {
+        return nil, err
+    }
+    l.cur.pending.Add(1)
+    return l.cur, nil
+}
+
+/* Appends a change of given kind, already applied to store, to current segment
+ */
+func (l *writeAheadLog) AppendRecord(kind string, v interface{}) error {
+    rec, err := walRecord(kind, v)
+    if err != nil {
+        return err
+    }
+
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return l.write(rec)
+}
+
+/* Returns record of v, prefixed by its kind unless it is a location update
+ */
+func walRecord(kind string, v interface{}) ([]byte, error) {
+    b, err := json.Marshal(v)
+    if err != nil || kind == "" {
+        return b, err
+    }
+    return append([]byte(kind + " "), b...), nil
+}
+
+/* Writes the record with its checksum to current segment; mu must be held
+ */
+func (l *writeAheadLog) write(rec []byte) error {
+    if _, err := fmt.Fprintf(l.cur.w, "%08x %s\n", crc32.ChecksumIEEE(rec), rec); err != nil {
+        return err
+    }
+    l.dirty = true
+    return nil
+}
+
+/* Appends a change applied to store to the log in use, if any. A failure is
+ * only logged, as the change is already applied and would be in next snapshot
+ */
+func logChange(ctx context.Context, kind string, v interface{}) {
+    if wal == nil {
+        return
+    }
+    if err := wal.AppendRecord(kind, v); err != nil {
+        logCtx(ctx, LOG_ERROR, "Error appending %s to write-ahead log: %s", kind, err.Error())
+    }
+}
+
+/* Flushes buffered records of current segment to disk. Only the flush to
+ * the file is done holding mu; Appends carry on while it is fsync'ed
+ */
+func (l *writeAheadLog) Sync() error {
+    l.syncMu.Lock()
+    defer l.syncMu.Unlock()
+
+    l.mu.Lock()
+    if !l.dirty {
+        l.mu.Unlock()
+        return nil
+    }
+    file := l.cur.file
+    err := l.cur.w.Flush()
+    if err == nil {
+        l.dirty = false
+    }
+    l.mu.Unlock()
+    if err != nil {
+        return err
+    }
+    return file.Sync()
+}
+
+/* Syncs the log every interval till stop is closed; meant to be run as a go routine
+ */
+func (l *writeAheadLog) runSync(interval time.Duration, stop <-chan bool) {
+    tick := time.NewTicker(interval)
+    defer tick.Stop()
+    for {
+        select {
+        case <-tick.C:
+            if err := l.Sync(); err != nil {
+                logError("Error in syncing write-ahead log - %v", err)
+            }
+        case <-stop:
+            return
+        }
+    }
+}
+
+/* Compacts the log into the snapshot at given path
+ */
+func (l *writeAheadLog) Compact(snapshot string) error {
+    l.syncMu.Lock()
+    l.mu.Lock()
+    old := l.cur
+    next, err := l.newSegment(old.seq + 1)
+    if err != nil {
+        l.mu.Unlock()
+        l.syncMu.Unlock()
+        return err
+    }
+    err = old.w.Flush()
+    l.cur = next
+    l.dirty = false
+    l.mu.Unlock()
+
+    /* no Append reaches old segment any more */
+    if err == nil {
+        err = old.file.Sync()
+    }
+    old.file.Close()
+    l.syncMu.Unlock()
+    if err != nil {
+        return err
+    }
+
+    /* snapshot must contain every update of old segments before they go */
+    old.pending.Wait()
+    if err := saveSnapshot(snapshot); err != nil {
+        return err
+    }
+    seqs, err := walSegments(l.dir)
+    if err != nil {
+        return err
+    }
+    for _, seq := range seqs {
+        if seq <= old.seq {
+            os.Remove(walSegmentPath(l.dir, seq))
+        }
+    }
+    return nil
+}
+
+/* Syncs and closes the current segment
+ */
+func (l *writeAheadLog) Close() error {
+    err := l.Sync()
+    l.syncMu.Lock()
+    defer l.syncMu.Unlock()
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if cerr := l.cur.file.Close(); err == nil {
+        err = cerr
+    }
+    return err
+}
+
+/* Removes every segment of a closed log. Meant for shutdown once all the
+ * updates are applied and saved in snapshot, so nothing is left to replay.
+ */
+func (l *writeAheadLog) Discard() error {
+    seqs, err := walSegments(l.dir)
+    if err != nil {
+        return err
+    }
+    for _, seq := range seqs {
+        if err := os.Remove(walSegmentPath(l.dir, seq)); err != nil {
+            return err
+        }
+    }
+    return nil
+}
@@ -6,31 +6,49 @@ package main
  */
 
 import (
-    "log"
+    "sync/atomic"
 )
 
-func NewWorker(workerPool chan chan Job) Worker {
+func NewWorker(d *Dispatcher) Worker {
     return Worker{
-        WorkerPool: workerPool,
-        JobChannel: make(chan Job),
+        Mailbox:    newMailbox(),
+        dispatcher: d,
         quit:       make(chan bool)}
 }
 
 /* Start method starts the run loop for the worker, listening for a 
- * quit channel in case we need to stop it
+ * quit channel in case we need to stop it.
+ * Jobs are applied one at a time in the order they are taken out of Mailbox
  */
 func (w Worker) Start() {
     go func() {
         for {
-            // register the current worker into the worker queue.
-            w.WorkerPool <- w.JobChannel
-
             select {
-            case job := <-w.JobChannel:
-                // we have received a work request.
-                if err := job.WriteToDB(); err != nil {
-                    log.Printf("Error updating in DB: %s", err.Error())
+            case <-w.Mailbox.ready:
+                // we have received work requests.
+                atomic.AddInt64(&w.dispatcher.busy, 1)
+                for job, ok := w.Mailbox.take(); ok; job, ok = w.Mailbox.take() {
+                    res := job.apply()
+                    if err := res.err; job.done != nil {
+                        job.done <- res         // request waiting on it tells the outcome
+                    } else if err == errStaleUpdate {
+                        // a stale update lost to a newer one of same driver is no failure
+                        atomic.AddInt64(&staleUpdates, 1)
+                    } else if err == errBadTransition {
+                        // status changed since this update was checked and queued
+                        atomic.AddInt64(&droppedStatuses, 1)
+                        logCtx(job.ctx, LOG_WARN, "Left out status %s of driver %v as not allowed now",
+                                    job.Payload.Status, job.Payload.Id)
+                    } else if err == errDriverInactive {
+                        // driver deactivated since this update was queued
+                        logCtx(job.ctx, LOG_INFO, "Left out update of deactivated driver %v", job.Payload.Id)
+                    } else if err != nil {
+                        atomic.AddInt64(&dbWriteErrors, 1)
+                        logCtx(job.ctx, LOG_ERROR, "Error updating in DB: %s", err.Error())
+                    }
+                    w.dispatcher.applied(job)
                 }
+                atomic.AddInt64(&w.dispatcher.busy, -1)
 
             case <-w.quit:
                 // we have received a signal to stop